@@ -0,0 +1,589 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxAPIRequestBody is the largest JSON body the API will read.
+const maxAPIRequestBody = 1 << 20
+
+// twitchSubscriptionStatuses are the status filters Twitch accepts when
+// listing EventSub subscriptions.
+var twitchSubscriptionStatuses = []string{
+	"enabled",
+	"webhook_callback_verification_pending",
+	"webhook_callback_verification_failed",
+	"notification_failures_exceeded",
+	"authorization_revoked",
+	"moderator_removed",
+	"user_removed",
+	"version_removed",
+	"websocket_disconnected",
+	"websocket_failed_ping_pong",
+	"websocket_received_inbound_traffic",
+	"websocket_connection_unused",
+	"websocket_internal_error",
+	"websocket_network_timeout",
+	"websocket_network_error",
+}
+
+// apiError is how the REST API reports a failed request:
+// {"error": {"code": "...", "message": "..."}}.
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// apiStream is a stream as the REST API shows it.
+type apiStream struct {
+	ID              int64                 `json:"id"`
+	Type            string                `json:"type"`
+	Name            string                `json:"name"`
+	DisplayName     string                `json:"display_name,omitempty"`
+	UserID          string                `json:"user_id"`
+	Colour          string                `json:"colour"`
+	Description     string                `json:"description"`
+	OfflineTime     int64                 `json:"offline_time"`
+	RefreshInterval int64                 `json:"refresh_interval"`
+	PostSummary     bool                  `json:"post_summary"`
+	AnnounceTypes   []string              `json:"announce_types"`
+	BroadcastType   string                `json:"broadcast_type,omitempty"`
+	Template        *announcementTemplate `json:"template,omitempty"`
+	DisableOffline  bool                  `json:"disable_offline"`
+	IsLive          bool                  `json:"is_live"`
+	Title           string                `json:"title"`
+	Category        string                `json:"category"`
+	LastOffline     int64                 `json:"last_offline"`
+	Unsubscribed    bool                  `json:"unsubscribed"`
+	Targets         []discordChannel      `json:"targets"`
+
+	// Warning is set when a stream was added but could not be fully set up.
+	Warning string `json:"warning,omitempty"`
+}
+
+// apiStreamSettings is the body of a request that creates or updates a
+// stream. Fields left out of an update keep their current values.
+type apiStreamSettings struct {
+	Colour          *string   `json:"colour"`
+	Description     *string   `json:"description"`
+	OfflineTime     *int64    `json:"offline_time"`
+	DisableOffline  *bool     `json:"disable_offline"`
+	RefreshInterval *int64    `json:"refresh_interval"`
+	PostSummary     *bool     `json:"post_summary"`
+	AnnounceTypes   *[]string `json:"announce_types"`
+}
+
+type apiCreateStream struct {
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	UserID    string `json:"user_id"`
+	ChannelID string `json:"channel_id"`
+	apiStreamSettings
+}
+
+type apiCreateTarget struct {
+	ChannelID string         `json:"channel_id"`
+	Filter    *channelFilter `json:"filter"`
+}
+
+func (a *App) apiRoutes(handleFunc func(path string, handler Handler)) {
+	handleFunc("GET /api/v1/streams", a.requireAPIKey(a.handleAPIListStreams))
+	handleFunc("POST /api/v1/streams", a.requireAPIKey(a.handleAPICreateStream))
+	handleFunc("GET /api/v1/streams/{id}", a.requireAPIKey(a.handleAPIGetStream))
+	handleFunc("PATCH /api/v1/streams/{id}", a.requireAPIKey(a.handleAPIUpdateStream))
+	handleFunc("DELETE /api/v1/streams/{id}", a.requireAPIKey(a.handleAPIDeleteStream))
+	handleFunc("GET /api/v1/streams/{id}/targets", a.requireAPIKey(a.handleAPIListTargets))
+	handleFunc("POST /api/v1/streams/{id}/targets", a.requireAPIKey(a.handleAPIAddTarget))
+	handleFunc("DELETE /api/v1/streams/{id}/targets/{channel}", a.requireAPIKey(a.handleAPIRemoveTarget))
+	handleFunc("PUT /api/v1/streams/{id}/targets/{channel}/filter", a.requireAPIKey(a.handleAPISetTargetFilter))
+	handleFunc("PUT /api/v1/streams/{id}/template", a.requireAPIKey(a.handleAPISetTemplate))
+	handleFunc("PUT /api/v1/streams/{id}/targets/{channel}/template", a.requireAPIKey(a.handleAPISetTemplate))
+	handleFunc("GET /api/v1/subscriptions/twitch", a.requireAPIKey(a.handleAPITwitchSubscriptions))
+	handleFunc("GET /api/v1/subscriptions/youtube", a.requireAPIKey(a.handleAPIYoutubeLeases))
+	handleFunc("GET /api/v1/subscriptions/budget", a.requireAPIKey(a.handleAPISubscriptionBudget))
+	handleFunc("GET /api/v1/helix", a.requireAPIKey(a.handleAPIHelixStatus))
+	handleFunc("/api/", a.requireAPIKey(func(w http.ResponseWriter, r *http.Request) error {
+		return &apiError{http.StatusNotFound, "not_found", "no such endpoint"}
+	}))
+}
+
+// addAPIKey creates a new REST API key, saves its hash to the config and
+// returns the key. The key itself is not stored, so it cannot be shown again.
+// Keys another process added to the config since it was read are kept, and a
+// running bot picks the new key up from the config when it is first used.
+func (a *App) addAPIKey(name string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := "pb_" + base64.RawURLEncoding.EncodeToString(b)
+
+	a.configMu.Lock()
+	defer a.configMu.Unlock()
+	a.reloadAPIKeys()
+	a.config.APIKeys = append(a.config.APIKeys, apiKey{Name: name, Hash: hashAPIKey(key)})
+	a.writeConfigLocked()
+	return key, nil
+}
+
+// reloadAPIKeys takes the API keys from the config file if it was changed by
+// something other than this App, such as -add-api-key run alongside the bot.
+// configMu must be held.
+func (a *App) reloadAPIKeys() {
+	info, err := os.Stat(a.cfgPath)
+	if err != nil || (a.configFile != nil && os.SameFile(a.configFile, info) && info.ModTime().Equal(a.configFile.ModTime())) {
+		return
+	}
+	content, err := os.ReadFile(a.cfgPath)
+	if err != nil {
+		log.Printf("Could not reload API keys: %v\n", err)
+		return
+	}
+	var stored struct {
+		APIKeys []apiKey `json:"api_keys"`
+	}
+	if err = json.Unmarshal(content, &stored); err != nil {
+		log.Printf("Could not reload API keys: %v\n", err)
+		return
+	}
+	if len(stored.APIKeys) != len(a.config.APIKeys) {
+		log.Printf("Reloaded API keys from %v: %v keys\n", a.cfgPath, len(stored.APIKeys))
+	}
+	a.config.APIKeys = stored.APIKeys
+	a.configFile = info
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyName returns the name of the API key the request was made with, or
+// "" if it carries no valid key. An unknown key is looked for again after
+// reloading the keys, in case it was added since.
+func (a *App) apiKeyName(r *http.Request) string {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || key == "" {
+		return ""
+	}
+	hash := hashAPIKey(strings.TrimSpace(key))
+
+	a.configMu.Lock()
+	defer a.configMu.Unlock()
+	for reloaded := false; ; reloaded = true {
+		for _, k := range a.config.APIKeys {
+			if hmac.Equal([]byte(hash), []byte(k.Hash)) {
+				return k.Name
+			}
+		}
+		if reloaded {
+			return ""
+		}
+		a.reloadAPIKeys()
+	}
+}
+
+// requireAPIKey wraps a REST API handler so that it only runs for requests
+// with a valid API key. Errors from h are sent to the client as JSON rather
+// than going through errorHandling.
+func (a *App) requireAPIKey(h Handler) Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if a.apiKeyName(r) == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="paintbot"`)
+			writeAPIError(w, &apiError{http.StatusUnauthorized, "unauthorized", "a valid API key is required"})
+			return nil
+		}
+
+		err := h(w, r)
+		if err == nil {
+			return nil
+		}
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) {
+			apiErr = apiErrorFor(err)
+		}
+		if apiErr.Status == http.StatusInternalServerError {
+			log.Printf("API %v %v: %v\n", r.Method, r.URL.Path, err)
+		}
+		writeAPIError(w, apiErr)
+		return nil
+	}
+}
+
+// apiErrorFor maps the errors from managing streams to API errors.
+func apiErrorFor(err error) *apiError {
+	var input inputError
+	var helix *helixError
+	switch {
+	case errors.As(err, &input):
+		return &apiError{http.StatusBadRequest, "invalid_input", err.Error()}
+	case errors.Is(err, errTwitchUserNotFound):
+		return &apiError{http.StatusBadRequest, "unknown_twitch_user", err.Error()}
+	case errors.Is(err, errStreamNotFound), errors.Is(err, errTargetNotFound):
+		return &apiError{http.StatusNotFound, "not_found", err.Error()}
+	case errors.Is(err, errTargetExists):
+		return &apiError{http.StatusConflict, "target_exists", err.Error()}
+	case errors.As(err, &helix):
+		return &apiError{http.StatusBadGateway, "twitch_unavailable", err.Error()}
+	}
+	return &apiError{http.StatusInternalServerError, "internal", "something went wrong, please try again"}
+}
+
+func writeAPIError(w http.ResponseWriter, err *apiError) {
+	writeJSON(w, err.Status, map[string]*apiError{"error": err})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Could not write API response: %v\n", err)
+	}
+}
+
+// decodeAPIBody reads a JSON request body into v, refusing unknown fields.
+func decodeAPIBody(w http.ResponseWriter, r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return &apiError{http.StatusBadRequest, "invalid_json", "request body is not valid JSON: " + err.Error()}
+	}
+	return nil
+}
+
+// apiPathStream returns the stream named by the {id} path segment.
+func (a *App) apiPathStream(r *http.Request) (*streamInfo, error) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return nil, &apiError{http.StatusBadRequest, "invalid_input", fmt.Sprintf("%q is not a stream ID", r.PathValue("id"))}
+	}
+	stream := a.findStream(id)
+	if stream == nil {
+		return nil, &apiError{http.StatusNotFound, "not_found", fmt.Sprintf("no stream with ID %v", id)}
+	}
+	return stream, nil
+}
+
+func describeAPIStream(stream *streamInfo) apiStream {
+	var s apiStream
+	stream.withStream(func() {
+		s = apiStream{
+			ID:              stream.ID,
+			Type:            streamTypeName(stream.Type),
+			Name:            stream.StreamName,
+			DisplayName:     stream.DisplayName,
+			UserID:          stream.UserId,
+			Colour:          stream.ColourString,
+			Description:     stream.Description,
+			OfflineTime:     stream.OfflineTime,
+			DisableOffline:  stream.DisableOffline,
+			RefreshInterval: stream.RefreshInterval,
+			PostSummary:     stream.PostSummary,
+			AnnounceTypes:   stream.AnnounceTypes,
+			BroadcastType:   stream.BroadcastType,
+			Template:        stream.Template,
+			IsLive:          stream.IsLive,
+			Title:           stream.Title,
+			Category:        stream.Category,
+			LastOffline:     stream.LastOffline,
+			Unsubscribed:    stream.Unsubscribed,
+			Targets:         append([]discordChannel{}, stream.Channels...),
+		}
+	})
+	return s
+}
+
+func (a *App) handleAPIListStreams(w http.ResponseWriter, r *http.Request) error {
+	streams := []apiStream{}
+	for _, stream := range a.allStreams() {
+		streams = append(streams, describeAPIStream(stream))
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].ID < streams[j].ID })
+	writeJSON(w, http.StatusOK, streams)
+	return nil
+}
+
+func (a *App) handleAPIGetStream(w http.ResponseWriter, r *http.Request) error {
+	stream, err := a.apiPathStream(r)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, describeAPIStream(stream))
+	return nil
+}
+
+// handleAPICreateStream starts announcing a stream in a Discord channel. A
+// stream that is already tracked gets the channel added to its targets.
+func (a *App) handleAPICreateStream(w http.ResponseWriter, r *http.Request) error {
+	var body apiCreateStream
+	if err := decodeAPIBody(w, r, &body); err != nil {
+		return err
+	}
+	streamType, err := parseStreamType(body.Type)
+	if err != nil {
+		return err
+	}
+	if body.Colour != nil {
+		if _, err = parseColour(*body.Colour); err != nil {
+			return err
+		}
+	}
+	if body.OfflineTime != nil && *body.OfflineTime < 0 {
+		return inputError("offline time cannot be negative")
+	}
+	if body.RefreshInterval != nil {
+		if err = validateRefreshInterval(*body.RefreshInterval); err != nil {
+			return err
+		}
+	}
+	if body.AnnounceTypes != nil {
+		if err = validateAnnounceTypes(*body.AnnounceTypes); err != nil {
+			return err
+		}
+	}
+
+	var stream *streamInfo
+	switch streamType {
+	case twitchType:
+		stream, err = a.addTwitchStream(body.Name, body.ChannelID)
+	case youtubeType:
+		stream, err = a.addYoutubeStream(body.UserID, body.Name, body.ChannelID)
+	}
+	if stream == nil || errors.Is(err, errTargetExists) {
+		return err
+	}
+	var warning string
+	if err != nil {
+		// The stream was added but is not subscribed yet, for example for
+		// lack of subscription budget.
+		warning = err.Error()
+		log.Printf("API: %v\n", err)
+	}
+
+	if err = a.updateStream(stream, a.mergeSettings(stream, body.apiStreamSettings)); err != nil {
+		return err
+	}
+	log.Printf("%v added %v to <#%v> from the API\n", a.apiKeyName(r), stream.StreamName, body.ChannelID)
+	w.Header().Set("Location", "/api/v1/streams/"+strconv.FormatInt(stream.ID, 10))
+	created := describeAPIStream(stream)
+	created.Warning = warning
+	writeJSON(w, http.StatusCreated, created)
+	return nil
+}
+
+func (a *App) handleAPIUpdateStream(w http.ResponseWriter, r *http.Request) error {
+	stream, err := a.apiPathStream(r)
+	if err != nil {
+		return err
+	}
+	var body apiStreamSettings
+	if err = decodeAPIBody(w, r, &body); err != nil {
+		return err
+	}
+	if err = a.updateStream(stream, a.mergeSettings(stream, body)); err != nil {
+		return err
+	}
+	log.Printf("%v updated %v from the API\n", a.apiKeyName(r), stream.StreamName)
+	writeJSON(w, http.StatusOK, describeAPIStream(stream))
+	return nil
+}
+
+// mergeSettings fills in the settings missing from an API request with the
+// stream's current ones.
+func (a *App) mergeSettings(stream *streamInfo, body apiStreamSettings) streamSettings {
+	var settings streamSettings
+	stream.withStream(func() {
+		settings = streamSettings{
+			Description:     stream.Description,
+			OfflineTime:     stream.OfflineTime,
+			DisableOffline:  stream.DisableOffline,
+			RefreshInterval: stream.RefreshInterval,
+			PostSummary:     stream.PostSummary,
+			AnnounceTypes:   stream.AnnounceTypes,
+		}
+	})
+	if body.Colour != nil {
+		settings.Colour = strings.TrimSpace(*body.Colour)
+	}
+	if body.Description != nil {
+		settings.Description = *body.Description
+	}
+	if body.OfflineTime != nil {
+		settings.OfflineTime = *body.OfflineTime
+	}
+	if body.DisableOffline != nil {
+		settings.DisableOffline = *body.DisableOffline
+	}
+	if body.RefreshInterval != nil {
+		settings.RefreshInterval = *body.RefreshInterval
+	}
+	if body.PostSummary != nil {
+		settings.PostSummary = *body.PostSummary
+	}
+	if body.AnnounceTypes != nil {
+		settings.AnnounceTypes = *body.AnnounceTypes
+	}
+	return settings
+}
+
+func (a *App) handleAPIDeleteStream(w http.ResponseWriter, r *http.Request) error {
+	stream, err := a.apiPathStream(r)
+	if err != nil {
+		return err
+	}
+	if err = a.deleteStream(stream); err != nil {
+		return err
+	}
+	log.Printf("%v removed %v from the API\n", a.apiKeyName(r), stream.StreamName)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (a *App) handleAPIListTargets(w http.ResponseWriter, r *http.Request) error {
+	stream, err := a.apiPathStream(r)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, describeAPIStream(stream).Targets)
+	return nil
+}
+
+func (a *App) handleAPIAddTarget(w http.ResponseWriter, r *http.Request) error {
+	stream, err := a.apiPathStream(r)
+	if err != nil {
+		return err
+	}
+	var body apiCreateTarget
+	if err = decodeAPIBody(w, r, &body); err != nil {
+		return err
+	}
+	body.ChannelID = strings.TrimSpace(body.ChannelID)
+	if err = validateChannelID(body.ChannelID); err != nil {
+		return err
+	}
+	if body.Filter != nil {
+		if err = body.Filter.validate(); err != nil {
+			return err
+		}
+	}
+	if err = a.addTarget(stream, body.ChannelID); err != nil {
+		return err
+	}
+	if body.Filter != nil {
+		if err = a.setTargetFilter(stream, body.ChannelID, body.Filter); err != nil {
+			return err
+		}
+	}
+	log.Printf("%v added %v to <#%v> from the API\n", a.apiKeyName(r), stream.StreamName, body.ChannelID)
+	writeJSON(w, http.StatusCreated, describeAPIStream(stream).Targets)
+	return nil
+}
+
+// handleAPISetTargetFilter replaces the filter of one of a stream's channels.
+// A null body removes it.
+func (a *App) handleAPISetTargetFilter(w http.ResponseWriter, r *http.Request) error {
+	stream, err := a.apiPathStream(r)
+	if err != nil {
+		return err
+	}
+	var filter *channelFilter
+	if err = decodeAPIBody(w, r, &filter); err != nil {
+		return err
+	}
+	if err = a.setTargetFilter(stream, r.PathValue("channel"), filter); err != nil {
+		return err
+	}
+	log.Printf("%v changed the filter of %v in <#%v> from the API\n", a.apiKeyName(r), stream.StreamName, r.PathValue("channel"))
+	writeJSON(w, http.StatusOK, describeAPIStream(stream).Targets)
+	return nil
+}
+
+// handleAPISetTemplate replaces the announcement template of a stream, or of
+// one of its channels. A null or empty body goes back to the default layout.
+func (a *App) handleAPISetTemplate(w http.ResponseWriter, r *http.Request) error {
+	stream, err := a.apiPathStream(r)
+	if err != nil {
+		return err
+	}
+	var t *announcementTemplate
+	if err = decodeAPIBody(w, r, &t); err != nil {
+		return err
+	}
+	channelID := r.PathValue("channel")
+	if err = a.setStreamTemplate(stream, channelID, t); err != nil {
+		return err
+	}
+	if channelID == "" {
+		log.Printf("%v changed the template of %v from the API\n", a.apiKeyName(r), stream.StreamName)
+	} else {
+		log.Printf("%v changed the template of %v in <#%v> from the API\n", a.apiKeyName(r), stream.StreamName, channelID)
+	}
+	writeJSON(w, http.StatusOK, describeAPIStream(stream))
+	return nil
+}
+
+// handleAPIRemoveTarget stops announcing a stream in one channel. Removing
+// the last channel deletes the stream.
+func (a *App) handleAPIRemoveTarget(w http.ResponseWriter, r *http.Request) error {
+	stream, err := a.apiPathStream(r)
+	if err != nil {
+		return err
+	}
+	if err = a.removeStreamTarget(stream, r.PathValue("channel")); err != nil {
+		return err
+	}
+	log.Printf("%v removed %v from <#%v> from the API\n", a.apiKeyName(r), stream.StreamName, r.PathValue("channel"))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleAPITwitchSubscriptions lists our EventSub subscriptions as Twitch
+// reports them, optionally filtered with ?status=.
+func (a *App) handleAPITwitchSubscriptions(w http.ResponseWriter, r *http.Request) error {
+	status := r.URL.Query().Get("status")
+	if status != "" {
+		known := false
+		for _, s := range twitchSubscriptionStatuses {
+			known = known || s == status
+		}
+		if !known {
+			return inputError(fmt.Sprintf("unknown subscription status %q", status))
+		}
+	}
+	subs, err := a.getSubscriptions(status)
+	if err != nil {
+		return &apiError{http.StatusBadGateway, "twitch_unavailable", "could not list subscriptions from Twitch: " + err.Error()}
+	}
+	if subs.Data == nil {
+		subs.Data = []subscriptionInfo{}
+	}
+	writeJSON(w, http.StatusOK, subs)
+	return nil
+}
+
+// handleAPIYoutubeLeases lists the WebSub leases requested since the bot
+// started and whether the hub has confirmed them.
+func (a *App) handleAPIYoutubeLeases(w http.ResponseWriter, r *http.Request) error {
+	leases := a.youtubeLeaseState()
+	sort.Slice(leases, func(i, j int) bool { return leases[i].ChannelID < leases[j].ChannelID })
+	writeJSON(w, http.StatusOK, leases)
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// TestAddAPIKeyWhileRunning checks that a key added by another process, as
+// -add-api-key does, works on the running bot without a restart and is not
+// lost when the bot next saves its config.
+func TestAddAPIKeyWhileRunning(t *testing.T) {
+	fake := newFakeServices(t)
+	a := startTestApp(t, fake, nil, nil)
+
+	tool, err := NewApp(a.cfgPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := tool.addAPIKey("tool")
+	tool.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://"+a.Addr().String()+"/api/v1/streams", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("request with the new key returned %v", resp.Status)
+	}
+
+	a.writeConfig()
+	var stored cofiguration
+	content, _ := os.ReadFile(a.cfgPath)
+	if err = json.Unmarshal(content, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.APIKeys) != 1 || stored.APIKeys[0].Hash != hashAPIKey(key) {
+		t.Errorf("API keys saved by the bot = %v, want the new key", stored.APIKeys)
+	}
+}
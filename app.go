@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	defaultTwitchAPI  string = "https://api.twitch.tv/helix"
+	defaultTwitchAuth string = "https://id.twitch.tv/oauth2"
+	defaultYouTubeHub string = "https://pubsubhubbub.appspot.com/subscribe"
+	defaultDiscord    string = "https://discord.com/"
+
+	defaultTwitchEventSubWS string = "wss://eventsub.wss.twitch.tv/ws"
+
+	defaultListenAddr string = ":8080"
+)
+
+// App is one running bot. Everything it needs is owned by the App, so several
+// can run side by side in one process, each against its own config and, for
+// testing, its own fake Twitch, YouTube and Discord servers.
+type App struct {
+	cfgPath string
+	config  *cofiguration
+	client  *http.Client
+
+	store        Store
+	seenMessages *messageLog
+	discord      *discordgo.Session
+
+	appToken *appTokenSource
+	helix    *helixClient
+	// tokenMu guards the Twitch user access token in the config.
+	tokenMu sync.RWMutex
+
+	// sessionMu guards the ID of the current EventSub WebSocket session,
+	// which WebSocket subscriptions are bound to.
+	sessionMu         sync.RWMutex
+	eventSubSessionID string
+	reconcileMu       sync.Mutex
+
+	budgetMu      sync.Mutex
+	budget        subscriptionBudget
+	budgetAlerted bool
+	// subscriptionCosts is what a subscription costs for each broadcaster
+	// we have seen one for, by user ID. It is guarded by budgetMu.
+	subscriptionCosts map[string]int
+
+	// streamsMu guards which streams are in config.Streams. The fields of
+	// each stream are guarded by its own lock.
+	streamsMu sync.RWMutex
+	configMu  sync.Mutex
+	// configFile is the config file as last read or written by this App,
+	// to notice API keys added to it by another process.
+	configFile os.FileInfo
+
+	leasesMu      sync.Mutex
+	youtubeLeases map[string]*youtubeLease
+
+	listener net.Listener
+	server   *http.Server
+	done     chan struct{}
+}
+
+// NewApp loads the config at cfgPath and the streams from its store. Files the
+// bot keeps next to its config, like the database, are resolved relative to
+// the config's directory. If client is nil a default client is used.
+func NewApp(cfgPath string, client *http.Client) (*App, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	a := &App{
+		cfgPath:       cfgPath,
+		client:        client,
+		youtubeLeases: make(map[string]*youtubeLease),
+		done:          make(chan struct{}),
+	}
+
+	if err := a.loadConfig(); err != nil {
+		return nil, err
+	}
+	a.appToken = a.newAppTokenSource()
+	a.helix = a.newHelixClient()
+
+	var err error
+	a.store, err = a.openStore()
+	if err != nil {
+		return nil, err
+	}
+	if err = a.loadStreams(); err != nil {
+		a.store.Close()
+		return nil, err
+	}
+	a.seenMessages = loadMessageLog(a.dataPath(messageLogFile), time.Duration(a.config.MessageRetention)*time.Second, maxSeenMessages)
+
+	// One session is shared by everything that talks to Discord. Its REST
+	// calls work before Start opens the gateway connection.
+	a.discord, err = a.createDiscordSession()
+	if err != nil {
+		a.store.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// dataPath resolves a file name from the config relative to the config's
+// directory.
+func (a *App) dataPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(a.cfgPath), name)
+}
+
+func (a *App) setDefaultEndpoints() {
+	e := &a.config.Endpoints
+	if e.TwitchAPI == "" {
+		e.TwitchAPI = defaultTwitchAPI
+	}
+	if e.TwitchAuth == "" {
+		e.TwitchAuth = defaultTwitchAuth
+	}
+	if e.YouTubeHub == "" {
+		e.YouTubeHub = defaultYouTubeHub
+	}
+	if e.Discord == "" {
+		e.Discord = defaultDiscord
+	}
+	if e.TwitchEventSubWS == "" {
+		e.TwitchEventSubWS = defaultTwitchEventSubWS
+	}
+	e.TwitchAPI = strings.TrimSuffix(e.TwitchAPI, "/")
+	e.TwitchAuth = strings.TrimSuffix(e.TwitchAuth, "/")
+	if a.config.ListenAddr == "" {
+		a.config.ListenAddr = defaultListenAddr
+	}
+}
+
+// Start gets a Twitch token, starts serving webhooks, makes sure every stream
+// is subscribed and connects to Discord. When rotateSecret is set a new
+// EventSub secret is generated and the webhook subscriptions are recreated.
+func (a *App) Start(rotateSecret bool) error {
+	if _, err := a.accessToken(); err != nil {
+		// Every Twitch request asks for a token again, so carry on and let
+		// them retry rather than failing to start.
+		log.Printf("Could not get a Twitch token, will retry: %v\n", err)
+	}
+	go a.runTokenValidation()
+
+	a.ensureEventSubSecret(rotateSecret)
+	a.ensureSessionSecret()
+
+	if err := a.startListen(); err != nil {
+		return err
+	}
+
+	websocket := a.config.EventSubTransport == websocketTransport
+	if websocket && a.config.Secrets.TwitchUserToken == "" {
+		return errors.New("the websocket EventSub transport needs secrets.twitch_user_token")
+	}
+	// The previous secret is kept until reconcile has replaced the
+	// subscriptions made with it, so one still set at startup is a rotation
+	// that did not finish.
+	_, previousSecret := a.eventSubSecrets()
+	if a.setupSubscriptions() && previousSecret != "" {
+		go a.retirePreviousSecret()
+	}
+	if websocket {
+		go a.runEventSubWebSocket()
+	}
+	go a.runSubscriptionSync()
+	go a.runLiveRefresh()
+
+	a.discord.AddHandler(func(discord *discordgo.Session, ready *discordgo.Ready) {
+		servers := discord.State.Guilds
+		log.Printf("PaintBot has started on %d servers\n", len(servers))
+		a.registerCommands(discord, ready)
+	})
+	a.discord.AddHandler(a.handleInteraction)
+
+	if subs, err := a.getSubscriptions("enabled"); err == nil {
+		log.Println(subs)
+	}
+
+	return a.discord.Open()
+}
+
+// setupSubscriptions looks up missing Twitch user IDs, subscribes to YouTube
+// channels and, for webhooks, reconciles the Twitch subscriptions. WebSocket
+// subscriptions are reconciled once the session is welcomed. It reports
+// whether every webhook subscription is in place.
+func (a *App) setupSubscriptions() bool {
+	a.resolveTwitchUserIDs()
+	for _, currStream := range a.allStreams() {
+		currStream.withStream(func() {
+			if currStream.Type == youtubeType {
+				a.setupYouTubeNotification(currStream)
+			}
+		})
+	}
+
+	if a.config.EventSubTransport != websocketTransport {
+		return a.reconcileSubscriptions()
+	}
+	return true
+}
+
+// resolveTwitchUserIDs looks up the user ID and display name of every Twitch
+// stream that does not have an ID yet, in as few requests as possible.
+func (a *App) resolveTwitchUserIDs() {
+	var logins []string
+	var streams []*streamInfo
+	for _, stream := range a.allStreams() {
+		stream.withStream(func() {
+			if stream.Type == twitchType && stream.UserId == "" {
+				logins = append(logins, stream.StreamName)
+				streams = append(streams, stream)
+			}
+		})
+	}
+	if len(logins) == 0 {
+		return
+	}
+
+	users, err := a.helix.Users(logins)
+	if err != nil {
+		log.Printf("Could not look up Twitch user IDs: %v\n", err)
+	}
+	for _, stream := range streams {
+		stream.withStream(func() {
+			user, ok := users[strings.ToLower(stream.StreamName)]
+			if !ok {
+				if err == nil {
+					log.Printf("Could not find a Twitch user ID for %v\n", stream.StreamName)
+				}
+				return
+			}
+			stream.UserId = user.ID
+			stream.setTwitchNames(user.Login, user.DisplayName)
+			a.saveStream(stream)
+		})
+	}
+}
+
+// Addr returns the address the webhook server is listening on, once started.
+func (a *App) Addr() net.Addr {
+	if a.listener == nil {
+		return nil
+	}
+	return a.listener.Addr()
+}
+
+// Close stops the webhook server, disconnects from Discord and closes the
+// store. Events still queued for streams are dropped.
+func (a *App) Close() error {
+	close(a.done)
+
+	var errs []error
+	if a.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		errs = append(errs, a.server.Shutdown(ctx))
+		cancel()
+	}
+	errs = append(errs, a.discord.Close())
+	errs = append(errs, a.store.Close())
+	a.seenMessages.close()
+	return errors.Join(errs...)
+}
+
+func (a *App) createDiscordSession() (*discordgo.Session, error) {
+	log.Println("Starting bot...")
+	discord, err := discordgo.New("Bot " + a.config.Secrets.BotToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.config.Endpoints.Discord != defaultDiscord {
+		to, err := url.Parse(a.config.Endpoints.Discord)
+		if err != nil {
+			return nil, err
+		}
+		from, _ := url.Parse(defaultDiscord)
+		discord.Client = &http.Client{
+			Timeout:   discord.Client.Timeout,
+			Transport: &baseURLTransport{from: from, to: to, next: a.client.Transport},
+		}
+	}
+	log.Println("New session created...")
+	return discord, nil
+}
+
+// baseURLTransport sends requests meant for one host to another base URL, for
+// libraries like discordgo whose endpoints are fixed.
+type baseURLTransport struct {
+	from *url.URL
+	to   *url.URL
+	next http.RoundTripper
+}
+
+func (t *baseURLTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if req.URL.Host != t.from.Host {
+		return next.RoundTrip(req)
+	}
+
+	redirected := req.Clone(req.Context())
+	redirected.URL.Scheme = t.to.Scheme
+	redirected.URL.Host = t.to.Host
+	redirected.URL.Path = strings.TrimSuffix(t.to.Path, "/") + req.URL.Path
+	redirected.Host = ""
+	return next.RoundTrip(redirected)
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+)
+
+const testEventSubSecret = "test-eventsub-secret"
+
+// discordAPI is where discordgo's REST endpoints live on the fake.
+var discordAPI = "/api/v" + discordgo.APIVersion
+
+// fakeServices stands in for Twitch's auth and Helix APIs and for Discord's
+// REST API and gateway, all on one test server.
+type fakeServices struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu            sync.Mutex
+	users         map[string]twitchUser
+	live          map[string]twitchStream
+	subscriptions []subscriptionInfo
+	messages      []fakeMessage
+	channelGuilds map[string]string
+	nextID        int
+
+	// helixHook, when set, is called before every Helix request is
+	// answered, so tests can hold requests up.
+	helixHook func(r *http.Request)
+}
+
+// fakeMessage is a message the bot posted to, or edited in, Discord.
+type fakeMessage struct {
+	Method    string
+	ChannelID string
+	MessageID string
+	Content   string
+	Embeds    []*discordgo.MessageEmbed
+}
+
+func newFakeServices(t *testing.T) *fakeServices {
+	f := &fakeServices{
+		t:             t,
+		users:         make(map[string]twitchUser),
+		live:          make(map[string]twitchStream),
+		channelGuilds: make(map[string]string),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"access_token": "app-token", "token_type": "bearer", "expires_in": 3600})
+	})
+	mux.HandleFunc("GET /oauth2/validate", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"client_id": "client-id", "expires_in": 3600})
+	})
+
+	mux.HandleFunc("GET /helix/users", f.helix(f.handleUsers))
+	mux.HandleFunc("GET /helix/channels", f.helix(f.handleChannels))
+	mux.HandleFunc("GET /helix/games", f.helix(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"data": []twitchGame{{ID: r.URL.Query().Get("id"), Name: "Art", BoxArt: "https://example.com/{width}x{height}.jpg"}}})
+	}))
+	mux.HandleFunc("GET /helix/streams", f.helix(f.handleStreams))
+	mux.HandleFunc("GET /helix/videos", f.helix(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"data": []twitchVideo{}})
+	}))
+	mux.HandleFunc("GET /helix/eventsub/subscriptions", f.helix(f.handleListSubscriptions))
+	mux.HandleFunc("POST /helix/eventsub/subscriptions", f.helix(f.handleCreateSubscription))
+	mux.HandleFunc("DELETE /helix/eventsub/subscriptions", f.helix(f.handleDeleteSubscription))
+
+	mux.HandleFunc("GET "+discordAPI+"/gateway", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"url": "ws" + strings.TrimPrefix(f.server.URL, "http") + "/gateway"})
+	})
+	mux.HandleFunc("GET /gateway/", f.handleGateway)
+	mux.HandleFunc("PUT "+discordAPI+"/applications/{app}/commands", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []any{})
+	})
+	mux.HandleFunc("GET "+discordAPI+"/channels/{channel}", f.handleChannel)
+	mux.HandleFunc("POST "+discordAPI+"/channels/{channel}/messages", f.handleMessage)
+	mux.HandleFunc("PATCH "+discordAPI+"/channels/{channel}/messages/{message}", f.handleMessage)
+	mux.HandleFunc("DELETE "+discordAPI+"/channels/{channel}/messages/{message}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /hub", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %v %v", r.Method, r.URL)
+		http.NotFound(w, r)
+	})
+
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeServices) addUser(id string, login string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users[id] = twitchUser{ID: id, Login: login, DisplayName: strings.ToUpper(login), ProfileImage: "https://example.com/" + login + ".png"}
+}
+
+// addChannel makes a Discord text channel in the given guild.
+func (f *fakeServices) addChannel(channelID string, guildID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.channelGuilds[channelID] = guildID
+}
+
+func (f *fakeServices) setHelixHook(hook func(r *http.Request)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.helixHook = hook
+}
+
+// sentMessages returns the messages posted and edited so far.
+func (f *fakeServices) sentMessages() []fakeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeMessage(nil), f.messages...)
+}
+
+func (f *fakeServices) currentSubscriptions() []subscriptionInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]subscriptionInfo(nil), f.subscriptions...)
+}
+
+func (f *fakeServices) helix(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Client-Id") == "" || !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.mu.Lock()
+		hook := f.helixHook
+		f.mu.Unlock()
+		if hook != nil {
+			hook(r)
+		}
+		handler(w, r)
+	}
+}
+
+func (f *fakeServices) handleUsers(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	users := []twitchUser{}
+	for _, user := range f.users {
+		for _, id := range query["id"] {
+			if user.ID == id {
+				users = append(users, user)
+			}
+		}
+		for _, login := range query["login"] {
+			if user.Login == strings.ToLower(login) {
+				users = append(users, user)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"data": users})
+}
+
+func (f *fakeServices) handleChannels(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := r.URL.Query().Get("broadcaster_id")
+	user := f.users[id]
+	channel := twitchChannel{ID: id, Login: user.Login, DisplayName: user.DisplayName, GameID: "509660", GameName: "Art", Title: "Painting with " + user.Login}
+	writeJSON(w, http.StatusOK, map[string]any{"data": []twitchChannel{channel}})
+}
+
+// handleStreams pages its results like Helix does, 20 to a page unless first
+// asks for more. Only the first page is ever returned.
+func (f *fakeServices) handleStreams(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	first, err := strconv.Atoi(r.URL.Query().Get("first"))
+	if err != nil {
+		first = 20
+	}
+	streams := []twitchStream{}
+	for _, id := range r.URL.Query()["user_id"] {
+		if stream, ok := f.live[id]; ok && len(streams) < first {
+			streams = append(streams, stream)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"data": streams})
+}
+
+// goLive makes the user live with the given number of viewers.
+func (f *fakeServices) goLive(id string, viewers int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	user := f.users[id]
+	f.live[id] = twitchStream{ID: "stream-" + id, UserID: id, UserLogin: user.Login, UserName: user.DisplayName, Type: "live", ViewerCount: viewers}
+}
+
+func (f *fakeServices) handleListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeJSON(w, http.StatusOK, f.subscriptionList(f.subscriptions))
+}
+
+func (f *fakeServices) handleCreateSubscription(w http.ResponseWriter, r *http.Request) {
+	var create createSubscription
+	if err := json.NewDecoder(r.Body).Decode(&create); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, sub := range f.subscriptions {
+		if sub.Type == create.EventType && sub.Condition["broadcaster_user_id"] == create.Condition["broadcaster_user_id"] &&
+			sub.Transport["method"] == create.Transport.Method && sub.Transport["session_id"] == create.Transport.SessionID &&
+			sub.Transport["callback"] == create.Transport.Callback {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+	}
+	f.nextID++
+	transport := map[string]string{"method": create.Transport.Method}
+	if create.Transport.Callback != "" {
+		transport["callback"] = create.Transport.Callback
+	}
+	if create.Transport.SessionID != "" {
+		transport["session_id"] = create.Transport.SessionID
+	}
+	sub := subscriptionInfo{
+		ID:        fmt.Sprintf("sub-%d", f.nextID),
+		Status:    "enabled",
+		Type:      create.EventType,
+		Version:   create.Version,
+		Condition: create.Condition,
+		Transport: transport,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	f.subscriptions = append(f.subscriptions, sub)
+	writeJSON(w, http.StatusAccepted, f.subscriptionList([]subscriptionInfo{sub}))
+}
+
+func (f *fakeServices) handleDeleteSubscription(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := r.URL.Query().Get("id")
+	for i, sub := range f.subscriptions {
+		if sub.ID == id {
+			f.subscriptions = append(f.subscriptions[:i], f.subscriptions[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// subscriptionList is a page of subscriptions as Helix returns them. Every
+// subscription costs nothing, as for broadcasters who authorised the app.
+// The fake must be locked.
+func (f *fakeServices) subscriptionList(data []subscriptionInfo) twitchSubscription {
+	list := twitchSubscription{Total: len(f.subscriptions), Data: data, MaxTotalCost: 10000}
+	if list.Data == nil {
+		list.Data = []subscriptionInfo{}
+	}
+	return list
+}
+
+func (f *fakeServices) handleChannel(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	channelID := r.PathValue("channel")
+	guildID, ok := f.channelGuilds[channelID]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]any{"code": 10003, "message": "Unknown Channel"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"id": channelID, "guild_id": guildID, "type": discordgo.ChannelTypeGuildText})
+}
+
+func (f *fakeServices) handleMessage(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Content string                    `json:"content"`
+		Embeds  []*discordgo.MessageEmbed `json:"embeds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	messageID := r.PathValue("message")
+	if messageID == "" {
+		f.nextID++
+		messageID = fmt.Sprintf("%d", 1000+f.nextID)
+	}
+	channelID := r.PathValue("channel")
+	f.messages = append(f.messages, fakeMessage{Method: r.Method, ChannelID: channelID, MessageID: messageID, Content: body.Content, Embeds: body.Embeds})
+	writeJSON(w, http.StatusOK, map[string]any{"id": messageID, "channel_id": channelID, "content": body.Content, "embeds": body.Embeds})
+}
+
+// handleGateway is just enough of Discord's gateway for the session to open:
+// a hello, and a ready once the bot identifies.
+func (f *fakeServices) handleGateway(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(map[string]any{"op": 10, "d": map[string]any{"heartbeat_interval": 45000}})
+	for {
+		var payload struct {
+			Op int `json:"op"`
+		}
+		if err := conn.ReadJSON(&payload); err != nil {
+			return
+		}
+		if payload.Op == 2 {
+			conn.WriteJSON(map[string]any{"op": 0, "s": 1, "t": "READY", "d": map[string]any{
+				"v":          9,
+				"session_id": "session",
+				"user":       map[string]any{"id": "100", "username": "PaintBot"},
+				"guilds":     []any{},
+			}})
+		}
+	}
+}
+
+// startTestApp writes a config pointing every service at fake, with streams
+// kept in it, and starts the bot from it. configure may change the config
+// before it is written.
+func startTestApp(t *testing.T, fake *fakeServices, streams []*streamInfo, configure func(*cofiguration)) *App {
+	t.Helper()
+	cfg := cofiguration{
+		Secrets: secrets{
+			BotToken:           "bot-token",
+			TwitchClientID:     "client-id",
+			TwitchClientSecret: "client-secret",
+			BaseUrl:            "paintbot.example.com",
+			EventSubSecret:     testEventSubSecret,
+		},
+		Streams:    streams,
+		Storage:    jsonStorage,
+		ListenAddr: "127.0.0.1:0",
+		Endpoints: endpoints{
+			TwitchAPI:  fake.server.URL + "/helix",
+			TwitchAuth: fake.server.URL + "/oauth2",
+			Discord:    fake.server.URL + "/",
+			YouTubeHub: fake.server.URL + "/hub",
+		},
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	content, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgPath := filepath.Join(t.TempDir(), "cfg.txt")
+	if err = os.WriteFile(cfgPath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewApp(cfgPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Start(false); err != nil {
+		a.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+// sendEventSub delivers a signed EventSub webhook message to the bot and
+// returns the response's status.
+func sendEventSub(t *testing.T, a *App, messageID string, messageType string, message any) int {
+	t.Helper()
+	body, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+	mac := hmac.New(sha256.New, []byte(testEventSubSecret))
+	mac.Write([]byte(messageID + timestamp))
+	mac.Write(body)
+
+	req, err := http.NewRequest("POST", "http://"+a.Addr().String()+"/notify", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(eventSubMessageIDHeader, messageID)
+	req.Header.Set(eventSubMessageTimestampHeader, timestamp)
+	req.Header.Set(eventSubMessageSignatureHeader, eventSubSignaturePrefix+hex.EncodeToString(mac.Sum(nil)))
+	req.Header.Set(eventSubMessageTypeHeader, messageType)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Errorf("delivering %v: %v", messageID, err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// twitchEvent is a notification of eventType for the broadcaster with the
+// given user ID and login.
+func twitchEvent(eventType string, userID string, login string, event map[string]any) notification {
+	if event == nil {
+		event = make(map[string]any)
+	}
+	event["broadcaster_user_id"] = userID
+	event["broadcaster_user_login"] = login
+	event["broadcaster_user_name"] = strings.ToUpper(login)
+	return notification{
+		SubscriptionInfo: subscriptionInfo{
+			ID:        "sub-" + eventType + "-" + userID,
+			Status:    "enabled",
+			Type:      eventType,
+			Version:   "1",
+			Condition: map[string]string{"broadcaster_user_id": userID},
+		},
+		Event: event,
+	}
+}
+
+// eventually fails the test if cond has not held within a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestStreamOnlineAnnounced runs the bot against fake Twitch and Discord
+// services: a signed stream.online delivered to /notify is announced in the
+// stream's channel, and a forged one is refused.
+func TestStreamOnlineAnnounced(t *testing.T) {
+	fake := newFakeServices(t)
+	fake.addUser("1", "streamer1")
+	a := startTestApp(t, fake, []*streamInfo{{
+		StreamName:   "streamer1",
+		UserId:       "1",
+		ColourString: "0x9146FF",
+		Type:         twitchType,
+		Channels:     []discordChannel{{ChannelID: "201"}},
+		Description:  "streamer1 is live!",
+	}}, nil)
+
+	if len(fake.currentSubscriptions()) != len(twitchEventTypes) {
+		t.Errorf("subscribed to %v, want %v", fake.currentSubscriptions(), twitchEventTypes)
+	}
+
+	online := twitchEvent("stream.online", "1", "streamer1", map[string]any{
+		"id":         "stream-1",
+		"type":       "live",
+		"started_at": time.Now().UTC().Format(time.RFC3339),
+	})
+	body, _ := json.Marshal(online)
+	req, _ := http.NewRequest("POST", "http://"+a.Addr().String()+"/notify", bytes.NewReader(body))
+	req.Header.Set(eventSubMessageIDHeader, "forged")
+	req.Header.Set(eventSubMessageTimestampHeader, time.Now().UTC().Format(time.RFC3339Nano))
+	req.Header.Set(eventSubMessageSignatureHeader, eventSubSignaturePrefix+"00")
+	req.Header.Set(eventSubMessageTypeHeader, "notification")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("forged notification returned %v, want 403", resp.StatusCode)
+	}
+
+	if status := sendEventSub(t, a, "online-1", "notification", online); status != http.StatusNoContent {
+		t.Fatalf("stream.online returned %v", status)
+	}
+	eventually(t, "the announcement", func() bool { return len(fake.sentMessages()) > 0 })
+
+	messages := fake.sentMessages()
+	if len(messages) != 1 {
+		t.Fatalf("sent %v messages, want 1", len(messages))
+	}
+	m := messages[0]
+	if m.Method != http.MethodPost || m.ChannelID != "201" {
+		t.Errorf("announced with %v in %v, want a POST to 201", m.Method, m.ChannelID)
+	}
+	if m.Content != "streamer1 is live!" {
+		t.Errorf("content = %q", m.Content)
+	}
+	if len(m.Embeds) != 1 || m.Embeds[0].Title != "Painting with streamer1" || m.Embeds[0].URL != "https://www.twitch.tv/streamer1" {
+		t.Errorf("embeds = %+v", m.Embeds)
+	}
+
+	stream := a.findChannel("1", twitchType)
+	stream.withStream(func() {
+		if !stream.IsLive || stream.Channels[0].MessageID != m.MessageID {
+			t.Errorf("stream is live %v with message %q, want live with %q", stream.IsLive, stream.Channels[0].MessageID, m.MessageID)
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writeFileAtomic replaces path with data so that readers, and the file left
+// behind after a crash, only ever see the old or the new contents. The data is
+// written to a temporary file in the same directory, synced and renamed over
+// path. When backups is above zero the previous contents are kept as path.1,
+// path.2 and so on, newest first.
+func writeFileAtomic(path string, data []byte, perm os.FileMode, backups int) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if backups > 0 {
+		if err = rotateBackups(path, backups); err != nil {
+			return err
+		}
+	}
+
+	if err = os.Rename(tmpName, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// rotateBackups shifts path.1 .. path.(n-1) up by one and makes path.1 a copy
+// of path, leaving path itself in place until it is replaced.
+func rotateBackups(path string, n int) error {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	for i := n - 1; i > 0; i-- {
+		err := os.Rename(backupName(path, i), backupName(path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	newest := backupName(path, 1)
+	if err := os.Link(path, newest); err == nil {
+		return nil
+	}
+	return copyFile(path, newest)
+}
+
+func backupName(path string, i int) string {
+	return path + "." + strconv.Itoa(i)
+}
+
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Not every platform can sync a directory; the rename itself has already
+	// happened, so this is best effort.
+	d.Sync()
+	return nil
+}
+
+// newestGoodBackup returns the most recent backup of path that holds valid
+// JSON, or an empty string if there is none.
+func newestGoodBackup(path string, backups int) string {
+	for i := 1; i <= backups; i++ {
+		name := backupName(path, i)
+		content, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		if err = validateConfig(content); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// validateConfig reports whether content is a usable configuration file.
+func validateConfig(content []byte) error {
+	if len(content) == 0 {
+		return errors.New("file is empty")
+	}
+	var cfg cofiguration
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return err
+	}
+	if cfg.Secrets.BotToken == "" {
+		return fmt.Errorf("no bot token set")
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestWriteFileAtomic checks that the file is replaced by a rename, so anyone
+// holding the old file still sees it whole, and that no temporary file is
+// left behind.
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cfg.txt")
+	if err := writeFileAtomic(path, []byte("old"), 0600, 0); err != nil {
+		t.Fatal(err)
+	}
+	held := filepath.Join(dir, "held")
+	if err := os.Link(path, held); err != nil {
+		t.Skipf("cannot hard link here: %v", err)
+	}
+
+	if err := writeFileAtomic(path, []byte("new"), 0600, 0); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "new" {
+		t.Errorf("%v holds %q, want new", path, content)
+	}
+	if content, _ := os.ReadFile(held); string(content) != "old" {
+		t.Errorf("the old file was changed in place to %q", content)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v (%v), want 0600", info.Mode().Perm(), err)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp") {
+			t.Errorf("temporary file %v was left behind", entry.Name())
+		}
+	}
+}
+
+func TestRotateBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cfg.txt")
+	for i := 1; i <= 5; i++ {
+		if err := writeFileAtomic(path, []byte(fmt.Sprint("version ", i)), 0600, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]string{
+		path:                "version 5",
+		backupName(path, 1): "version 4",
+		backupName(path, 2): "version 3",
+		backupName(path, 3): "version 2",
+	}
+	for name, contents := range want {
+		if got, err := os.ReadFile(name); err != nil || string(got) != contents {
+			t.Errorf("%v holds %q (%v), want %q", filepath.Base(name), got, err, contents)
+		}
+	}
+	if _, err := os.Stat(backupName(path, 4)); !os.IsNotExist(err) {
+		t.Errorf("more than 3 backups kept: %v", err)
+	}
+}
+
+// TestCorruptConfigRefused checks that a corrupt cfg.txt stops the bot, naming
+// the newest backup that is good to start from.
+func TestCorruptConfigRefused(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cfg.txt")
+	files := map[string]string{
+		path:                `{"secrets": {"bot_token": "tok`,
+		backupName(path, 1): ``,
+		backupName(path, 2): `{"secrets": {"bot_token": "older"}}`,
+		backupName(path, 3): `{"secrets": {"bot_token": "oldest"}}`,
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(name, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := NewApp(path, nil)
+	if err == nil {
+		t.Fatal("started from a corrupt config")
+	}
+	if !strings.Contains(err.Error(), "corrupt") || !strings.Contains(err.Error(), backupName(path, 2)) {
+		t.Errorf("error = %v, want it to name %v", err, backupName(path, 2))
+	}
+	if content, _ := os.ReadFile(path); string(content) != files[path] {
+		t.Error("the corrupt config was overwritten")
+	}
+
+	for i := 1; i <= 3; i++ {
+		os.Remove(backupName(path, i))
+	}
+	if _, err = NewApp(path, nil); err == nil || !strings.Contains(err.Error(), "no good backup") {
+		t.Errorf("error without backups = %v, want no good backup", err)
+	}
+}
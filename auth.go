@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/oauth2"
+)
+
+const (
+	sessionCookie    string = "paintbot_session"
+	oauthStateCookie string = "paintbot_oauth_state"
+	sessionLifetime         = 12 * time.Hour
+)
+
+var errNoSession = errors.New("not logged in")
+
+// dashboardSession is who is logged in to the dashboard. It is kept in a
+// cookie signed with the session secret, so nothing is stored server side.
+// Guilds are the servers the user manages that the dashboard serves; they
+// only see and change the streams announced there.
+type dashboardSession struct {
+	UserID   string   `json:"id"`
+	Username string   `json:"name"`
+	Guilds   []string `json:"guilds"`
+	Expires  int64    `json:"exp"`
+}
+
+// discordGuild is an entry in Discord's list of the current user's guilds.
+type discordGuild struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Owner       bool   `json:"owner"`
+	Permissions string `json:"permissions"`
+}
+
+// ensureSessionSecret creates the key dashboard sessions are signed with the
+// first time the bot starts.
+func (a *App) ensureSessionSecret() {
+	if a.config.Secrets.SessionSecret != "" {
+		return
+	}
+	a.config.Secrets.SessionSecret = generateEventSubSecret()
+	a.writeConfig()
+}
+
+func (a *App) dashboardOAuthConfig() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     a.config.Secrets.DiscordClientID,
+		ClientSecret: a.config.Secrets.DiscordClientSecret,
+		RedirectURL:  "https://" + a.config.Secrets.BaseUrl + "/dashboard/callback",
+		Scopes:       []string{"identify", "guilds"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   a.config.Endpoints.Discord + "oauth2/authorize",
+			TokenURL:  a.config.Endpoints.Discord + "api/oauth2/token",
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+	}
+}
+
+func (a *App) signSession(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(a.config.Secrets.SessionSecret))
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *App) setSession(w http.ResponseWriter, session dashboardSession) {
+	payload, _ := json.Marshal(session)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(payload) + "." + a.signSession(payload),
+		Path:     "/",
+		Expires:  time.Unix(session.Expires, 0),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// session returns the logged in dashboard user, if the request carries a
+// valid, unexpired session cookie.
+func (a *App) session(r *http.Request) (dashboardSession, error) {
+	var session dashboardSession
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return session, errNoSession
+	}
+	encoded, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return session, errNoSession
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return session, errNoSession
+	}
+	if !hmac.Equal([]byte(signature), []byte(a.signSession(payload))) {
+		return session, errNoSession
+	}
+	if err = json.Unmarshal(payload, &session); err != nil {
+		return session, errNoSession
+	}
+	// Sessions from before they were tied to guilds log in again.
+	if time.Now().Unix() > session.Expires || len(session.Guilds) == 0 {
+		return session, errNoSession
+	}
+	return session, nil
+}
+
+// csrfToken is sent with every dashboard form and checked on submission, tying
+// the form to the session that rendered it.
+func (a *App) csrfToken(session dashboardSession) string {
+	return a.signSession([]byte("csrf:" + session.UserID + ":" + strconv.FormatInt(session.Expires, 10)))
+}
+
+// requireLogin wraps a dashboard handler so that it only runs for a logged in
+// user, sending everyone else to log in. Form submissions must carry the
+// session's CSRF token.
+func (a *App) requireLogin(h func(w http.ResponseWriter, r *http.Request, session dashboardSession) error) Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		session, err := a.session(r)
+		if err != nil {
+			http.Redirect(w, r, "/dashboard/login", http.StatusSeeOther)
+			return nil
+		}
+		if r.Method == http.MethodPost && !hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(a.csrfToken(session))) {
+			http.Error(w, "Invalid form submission, please reload the page and try again.", http.StatusForbidden)
+			return nil
+		}
+		return h(w, r, session)
+	}
+}
+
+func (a *App) handleDashboardLogin(w http.ResponseWriter, r *http.Request) error {
+	if a.config.Secrets.DiscordClientID == "" {
+		http.Error(w, "The dashboard is not configured.", http.StatusNotFound)
+		return nil
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	state := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/dashboard/callback",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, a.dashboardOAuthConfig().AuthCodeURL(state), http.StatusFound)
+	return nil
+}
+
+func (a *App) handleDashboardCallback(w http.ResponseWriter, r *http.Request) error {
+	state, err := r.Cookie(oauthStateCookie)
+	if err != nil || state.Value == "" || r.URL.Query().Get("state") != state.Value {
+		http.Error(w, "Login expired, please try again.", http.StatusBadRequest)
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/dashboard/callback", MaxAge: -1})
+
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, a.client)
+	token, err := a.dashboardOAuthConfig().Exchange(ctx, r.URL.Query().Get("code"))
+	if err != nil {
+		return err
+	}
+
+	var user discordgo.User
+	if err = a.discordUserRequest(ctx, token, "api/users/@me", &user); err != nil {
+		return err
+	}
+	var guilds []discordGuild
+	if err = a.discordUserRequest(ctx, token, "api/users/@me/guilds", &guilds); err != nil {
+		return err
+	}
+
+	managed := a.managedGuilds(guilds)
+	if len(managed) == 0 {
+		log.Printf("Dashboard login refused for %v (%v)\n", user.Username, user.ID)
+		http.Error(w, "You need the Manage Server permission in a server PaintBot is in.", http.StatusForbidden)
+		return nil
+	}
+
+	log.Printf("Dashboard login for %v (%v)\n", user.Username, user.ID)
+	a.setSession(w, dashboardSession{
+		UserID:   user.ID,
+		Username: user.Username,
+		Guilds:   managed,
+		Expires:  time.Now().Add(sessionLifetime).Unix(),
+	})
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+	return nil
+}
+
+func (a *App) handleDashboardLogout(w http.ResponseWriter, r *http.Request, session dashboardSession) error {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+// managedGuilds returns the IDs of the user's guilds that the dashboard serves
+// and in which they have Manage Server. The dashboard serves the configured
+// guild, or every guild the bot is in when none is configured.
+func (a *App) managedGuilds(guilds []discordGuild) []string {
+	var managed []string
+	for _, guild := range guilds {
+		if a.config.DashboardGuildID != "" && guild.ID != a.config.DashboardGuildID {
+			continue
+		}
+		if _, err := a.discord.State.Guild(guild.ID); a.config.DashboardGuildID == "" && err != nil {
+			continue
+		}
+		permissions, _ := strconv.ParseInt(guild.Permissions, 10, 64)
+		if guild.Owner || permissions&(discordgo.PermissionManageServer|discordgo.PermissionAdministrator) != 0 {
+			managed = append(managed, guild.ID)
+		}
+	}
+	return managed
+}
+
+// discordUserRequest fetches path from the Discord API on behalf of the user
+// who owns token.
+func (a *App) discordUserRequest(ctx context.Context, token *oauth2.Token, path string, v any) error {
+	req, _ := http.NewRequestWithContext(ctx, "GET", a.config.Endpoints.Discord+path, nil)
+	token.SetAuthHeader(req)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("discord returned %v for %v", resp.Status, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// twitchBroadcastTypes are the kinds of broadcast stream.online reports.
+var twitchBroadcastTypes = []string{"live", "playlist", "watch_party", "premiere", "rerun"}
+
+// wording is how announcements describe a kind of broadcast, with %v for the
+// broadcaster's name. An empty live wording leaves the embed without a
+// description, as plain live streams have always been announced.
+type wording struct {
+	live  string
+	ended string
+}
+
+var broadcastWordings = map[string]wording{
+	"live":        {"", "%v was live."},
+	"playlist":    {"%v is playing a playlist.", "%v played a playlist."},
+	"watch_party": {"%v is hosting a watch party.", "%v hosted a watch party."},
+	"premiere":    {"%v is premiering a video.", "%v premiered a video."},
+	"rerun":       {"%v is showing a rerun.", "%v showed a rerun."},
+}
+
+// broadcastWording returns the wording for a kind of broadcast, treating
+// unknown kinds, and events from before the type was recorded, as live.
+func broadcastWording(broadcastType string) wording {
+	if w, ok := broadcastWordings[broadcastType]; ok {
+		return w
+	}
+	return broadcastWordings["live"]
+}
+
+// announces reports whether broadcasts of broadcastType are announced. Kinds
+// Twitch adds later are announced unless the stream limits the kinds.
+func (s *streamInfo) announces(broadcastType string) bool {
+	if len(s.AnnounceTypes) == 0 || broadcastType == "" {
+		return true
+	}
+	return slices.Contains(s.AnnounceTypes, broadcastType)
+}
+
+// validateAnnounceTypes checks that every kind of broadcast to announce is
+// one Twitch reports.
+func validateAnnounceTypes(types []string) error {
+	for _, t := range types {
+		if !slices.Contains(twitchBroadcastTypes, t) {
+			return inputError(fmt.Sprintf("%q is not a broadcast type, use one of %v", t, strings.Join(twitchBroadcastTypes, ", ")))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultCostReserve is how much of the EventSub cost budget is kept for
+	// stream.online subscriptions when the config does not say.
+	defaultCostReserve int = 10
+
+	// maxReserveShare caps the reserve at this fraction of max_total_cost, so
+	// small budgets, like the WebSocket transport's 10, still leave room for
+	// the other event types.
+	maxReserveShare = 10
+)
+
+var errSubscriptionBudget = errors.New("EventSub subscription cost budget exhausted")
+
+// subscriptionBudget is how much of Twitch's max_total_cost our
+// subscriptions use, as last reported by Twitch.
+type subscriptionBudget struct {
+	TotalCost    int       `json:"total_cost"`
+	MaxTotalCost int       `json:"max_total_cost"`
+	Remaining    int       `json:"remaining"`
+	Reserve      int       `json:"reserve"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// recordSubscriptionCost stores the cost Twitch reported with a subscription
+// listing or creation, and what each broadcaster's subscriptions cost: nothing
+// once they have authorised the app, one otherwise.
+func (a *App) recordSubscriptionCost(subs twitchSubscription) {
+	a.budgetMu.Lock()
+	defer a.budgetMu.Unlock()
+	if a.subscriptionCosts == nil {
+		a.subscriptionCosts = make(map[string]int)
+	}
+	for _, sub := range subs.Data {
+		if userID := sub.Condition["broadcaster_user_id"]; userID != "" {
+			a.subscriptionCosts[userID] = sub.Cost
+		}
+	}
+	if subs.MaxTotalCost <= 0 {
+		return
+	}
+	a.budget.TotalCost = subs.TotalCost
+	a.budget.MaxTotalCost = subs.MaxTotalCost
+	a.budget.UpdatedAt = time.Now().UTC()
+}
+
+// releaseSubscriptionCost accounts for a deleted subscription until Twitch
+// next reports the total.
+func (a *App) releaseSubscriptionCost(cost int) {
+	a.budgetMu.Lock()
+	a.budget.TotalCost = max(a.budget.TotalCost-cost, 0)
+	a.budgetMu.Unlock()
+}
+
+// resetSubscriptionCost starts counting from nothing, for a new WebSocket
+// session: the previous session's subscriptions stopped counting against the
+// budget when it closed. The limit is kept until Twitch next reports it.
+func (a *App) resetSubscriptionCost() {
+	a.budgetMu.Lock()
+	a.budget.TotalCost = 0
+	a.budgetMu.Unlock()
+}
+
+// subscriptionBudget returns the current budget. MaxTotalCost is zero until
+// Twitch has reported it.
+func (a *App) subscriptionBudget() subscriptionBudget {
+	a.budgetMu.Lock()
+	defer a.budgetMu.Unlock()
+	budget := a.budget
+	budget.Reserve = min(a.config.CostReserve, budget.MaxTotalCost/maxReserveShare)
+	budget.Remaining = budget.MaxTotalCost - budget.TotalCost
+	return budget
+}
+
+// checkSubscriptionBudget reports whether there is room for one more
+// subscription of eventType for the broadcaster. stream.online is what
+// announcements depend on, so the other event types leave the reserve free for
+// it. Broadcasters whose subscriptions cost nothing can always subscribe; the
+// cost of one we have no subscriptions for yet is taken to be one.
+func (a *App) checkSubscriptionBudget(userID string, eventType string) error {
+	budget := a.subscriptionBudget()
+	a.budgetMu.Lock()
+	need, known := a.subscriptionCosts[userID]
+	a.budgetMu.Unlock()
+	if !known {
+		need = 1
+	}
+	if budget.MaxTotalCost == 0 || need == 0 {
+		return nil
+	}
+	if eventType != "stream.online" {
+		need += budget.Reserve
+	}
+	if budget.Remaining < need {
+		return fmt.Errorf("%w: %v of %v used, %v needs %v free", errSubscriptionBudget, budget.TotalCost, budget.MaxTotalCost, eventType, need)
+	}
+	return nil
+}
+
+// budgetExhausted alerts the admin the first time subscriptions cannot be made
+// for lack of budget, and again only once the budget has recovered in between.
+func (a *App) budgetExhausted(err error) {
+	a.budgetMu.Lock()
+	alerted := a.budgetAlerted
+	a.budgetAlerted = true
+	a.budgetMu.Unlock()
+
+	if !alerted {
+		a.alertAdmin(fmt.Sprintf("Cannot subscribe to Twitch events: %v. Remove streams or have broadcasters authorise the app to free up budget.", err))
+	}
+}
+
+// budgetRecovered notes that subscriptions can be made again.
+func (a *App) budgetRecovered() {
+	a.budgetMu.Lock()
+	a.budgetAlerted = false
+	a.budgetMu.Unlock()
+}
+
+func (a *App) handleAPISubscriptionBudget(w http.ResponseWriter, r *http.Request) error {
+	writeJSON(w, http.StatusOK, a.subscriptionBudget())
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckSubscriptionBudget(t *testing.T) {
+	tests := []struct {
+		name      string
+		total     int
+		max       int
+		costs     []subscriptionInfo
+		userID    string
+		eventType string
+		wantErr   bool
+	}{
+		{name: "webhook online", total: 9990, max: 10000, userID: "1", eventType: "stream.online"},
+		{name: "webhook update in reserve", total: 9990, max: 10000, userID: "1", eventType: "channel.update", wantErr: true},
+		{name: "webhook update", total: 9989, max: 10000, userID: "1", eventType: "channel.update"},
+		{name: "websocket update", total: 5, max: 10, userID: "1", eventType: "channel.update"},
+		{name: "websocket update in reserve", total: 9, max: 10, userID: "1", eventType: "stream.offline", wantErr: true},
+		{name: "websocket online", total: 9, max: 10, userID: "1", eventType: "stream.online"},
+		{name: "full", total: 10, max: 10, userID: "1", eventType: "stream.online", wantErr: true},
+		{
+			name:  "authorised broadcaster",
+			total: 10, max: 10,
+			costs:     []subscriptionInfo{{Cost: 0, Condition: map[string]string{"broadcaster_user_id": "1"}}},
+			userID:    "1",
+			eventType: "channel.update",
+		},
+		{
+			name:  "other broadcaster",
+			total: 10, max: 10,
+			costs:     []subscriptionInfo{{Cost: 0, Condition: map[string]string{"broadcaster_user_id": "1"}}},
+			userID:    "2",
+			eventType: "stream.online",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &App{config: &cofiguration{CostReserve: defaultCostReserve}}
+			a.recordSubscriptionCost(twitchSubscription{Data: tt.costs, TotalCost: tt.total, MaxTotalCost: tt.max})
+			err := a.checkSubscriptionBudget(tt.userID, tt.eventType)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkSubscriptionBudget() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errSubscriptionBudget) {
+				t.Errorf("error %v is not errSubscriptionBudget", err)
+			}
+		})
+	}
+}
+
+func TestResetSubscriptionCost(t *testing.T) {
+	a := &App{config: &cofiguration{CostReserve: defaultCostReserve}}
+	a.recordSubscriptionCost(twitchSubscription{TotalCost: 10, MaxTotalCost: 10})
+	if err := a.checkSubscriptionBudget("1", "stream.online"); err == nil {
+		t.Fatal("a full budget has room")
+	}
+
+	a.resetSubscriptionCost()
+	budget := a.subscriptionBudget()
+	if budget.TotalCost != 0 || budget.MaxTotalCost != 10 || budget.Remaining != 10 {
+		t.Errorf("after a reset the budget is %+v", budget)
+	}
+	if err := a.checkSubscriptionBudget("1", "stream.online"); err != nil {
+		t.Errorf("checkSubscriptionBudget() after a reset = %v", err)
+	}
+}
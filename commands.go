@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var manageServerPermission int64 = discordgo.PermissionManageServer
+
+var announceChannelTypes = []discordgo.ChannelType{
+	discordgo.ChannelTypeGuildText,
+	discordgo.ChannelTypeGuildNews,
+}
+
+// paintbotCommand is the /paintbot slash command, which manages the streams
+// announced in a server. Only members who can manage the server see it.
+var paintbotCommand = &discordgo.ApplicationCommand{
+	Name:                     "paintbot",
+	Description:              "Manage the streams PaintBot announces",
+	DefaultMemberPermissions: &manageServerPermission,
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+			Name:        "add",
+			Description: "Start announcing a stream",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "twitch",
+					Description: "Announce when a Twitch streamer goes live",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "login",
+							Description: "The streamer's Twitch login",
+							Required:    true,
+						},
+						{
+							Type:         discordgo.ApplicationCommandOptionChannel,
+							Name:         "channel",
+							Description:  "Channel to announce in, this one if not given",
+							ChannelTypes: announceChannelTypes,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "youtube",
+					Description: "Announce new uploads from a YouTube channel",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "channel-id",
+							Description: "The YouTube channel ID, starting with UC",
+							Required:    true,
+						},
+						{
+							Type:         discordgo.ApplicationCommandOptionChannel,
+							Name:         "channel",
+							Description:  "Channel to announce in, this one if not given",
+							ChannelTypes: announceChannelTypes,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "name",
+							Description: "Name to show for the channel in /paintbot list",
+						},
+					},
+				},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "remove",
+			Description: "Stop announcing a stream",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "type",
+					Description: "Where the stream is",
+					Required:    true,
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "Twitch", Value: "twitch"},
+						{Name: "YouTube", Value: "youtube"},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "name",
+					Description: "Twitch login or YouTube channel ID",
+					Required:    true,
+				},
+				{
+					Type:         discordgo.ApplicationCommandOptionChannel,
+					Name:         "channel",
+					Description:  "Only stop announcing in this channel",
+					ChannelTypes: announceChannelTypes,
+				},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "list",
+			Description: "List the streams PaintBot announces",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "preview",
+			Description: "Show how a Twitch stream's announcement looks with its templates",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "login",
+					Description: "The streamer's Twitch login",
+					Required:    true,
+				},
+				{
+					Type:         discordgo.ApplicationCommandOptionChannel,
+					Name:         "channel",
+					Description:  "Channel whose template to use, this one if not given",
+					ChannelTypes: announceChannelTypes,
+				},
+			},
+		},
+	},
+}
+
+// registerCommands replaces the bot's global application commands with ours
+// each time the gateway session is ready.
+func (a *App) registerCommands(discord *discordgo.Session, ready *discordgo.Ready) {
+	_, err := discord.ApplicationCommandBulkOverwrite(ready.User.ID, "", []*discordgo.ApplicationCommand{paintbotCommand})
+	if err != nil {
+		log.Printf("Could not register commands: %v\n", err)
+	}
+}
+
+func (a *App) handleInteraction(discord *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+	data := i.ApplicationCommandData()
+	if data.Name != paintbotCommand.Name {
+		return
+	}
+
+	if i.Member == nil || i.Member.Permissions&discordgo.PermissionManageServer == 0 {
+		err := discord.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "You need the Manage Server permission to use this command.",
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+		if err != nil {
+			log.Printf("Could not respond to command: %v\n", err)
+		}
+		return
+	}
+
+	// Subscribing can take longer than Discord waits for a first response.
+	err := discord.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+	})
+	if err != nil {
+		log.Printf("Could not respond to command: %v\n", err)
+		return
+	}
+
+	var edit *discordgo.WebhookEdit
+	if len(data.Options) > 0 && data.Options[0].Name == "preview" {
+		args := commandOptions(data.Options[0].Options)
+		target := args["channel"]
+		if target == "" {
+			target = i.ChannelID
+		}
+		edit = a.previewAnnouncement(i.GuildID, args["login"], target)
+	} else {
+		reply := a.runCommand(i.GuildID, i.ChannelID, data.Options)
+		edit = &discordgo.WebhookEdit{Content: &reply}
+	}
+	if _, err = discord.InteractionResponseEdit(i.Interaction, edit); err != nil {
+		log.Printf("Could not respond to command: %v\n", err)
+	}
+}
+
+// previewAnnouncement shows the announcement a Twitch stream would get in
+// channelID now, templates and all, without mentioning anyone. Like list and
+// remove, it only sees streams announced in guildID.
+func (a *App) previewAnnouncement(guildID string, login string, channelID string) *discordgo.WebhookEdit {
+	stream := a.findChannel(strings.TrimSpace(login), twitchType)
+	if stream == nil || len(a.guildTargets(stream, guildID)) == 0 {
+		reply := fmt.Sprintf("%v is not announced here.", login)
+		return &discordgo.WebhookEdit{Content: &reply}
+	}
+	if guild, err := a.channelGuild(channelID); err != nil || guild != guildID {
+		reply := fmt.Sprintf("<#%v> is not a channel in this server.", channelID)
+		return &discordgo.WebhookEdit{Content: &reply}
+	}
+
+	var message *discordgo.MessageSend
+	stream.withStream(func() {
+		target := discordChannel{ChannelID: channelID}
+		for _, t := range stream.Channels {
+			if t.ChannelID == channelID {
+				target = t
+			}
+		}
+		user, game := a.twitchDetails(stream)
+		message = a.announcement(stream, target, announcementFor(stream, user, game))
+	})
+	return &discordgo.WebhookEdit{
+		Content:         &message.Content,
+		Embeds:          &message.Embeds,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	}
+}
+
+// runCommand carries out a /paintbot subcommand issued in channelID of guildID
+// and returns the reply to show. Streams are only listed and removed where
+// they are announced in that guild.
+func (a *App) runCommand(guildID string, channelID string, options []*discordgo.ApplicationCommandInteractionDataOption) string {
+	if len(options) == 0 {
+		return "Unknown command."
+	}
+	sub := options[0]
+	args := commandOptions(sub.Options)
+
+	switch sub.Name {
+	case "add":
+		if len(sub.Options) == 0 {
+			return "Unknown command."
+		}
+		kind := sub.Options[0]
+		args = commandOptions(kind.Options)
+		target := args["channel"]
+		if target == "" {
+			target = channelID
+		}
+
+		var stream *streamInfo
+		var err error
+		switch kind.Name {
+		case "twitch":
+			stream, err = a.addTwitchStream(args["login"], target)
+		case "youtube":
+			stream, err = a.addYoutubeStream(args["channel-id"], args["name"], target)
+		default:
+			return "Unknown command."
+		}
+		if errors.Is(err, errTargetExists) {
+			return fmt.Sprintf("%v is already announced in <#%v>.", stream.StreamName, target)
+		}
+		if err != nil {
+			return fmt.Sprintf("Could not add %v: %v", kind.Name, err)
+		}
+		return fmt.Sprintf("Now announcing %v in <#%v>.", stream.StreamName, target)
+
+	case "remove":
+		streamType, err := parseStreamType(args["type"])
+		if err != nil {
+			return err.Error()
+		}
+		stream, err := a.removeTarget(streamType, args["name"], guildID, args["channel"])
+		if err != nil {
+			return fmt.Sprintf("Could not remove %v: %v", args["name"], err)
+		}
+		if args["channel"] != "" && a.tracking(stream) {
+			return fmt.Sprintf("No longer announcing %v in <#%v>.", stream.StreamName, args["channel"])
+		}
+		return fmt.Sprintf("No longer announcing %v here.", stream.StreamName)
+
+	case "list":
+		return a.listStreams(guildID)
+	}
+	return "Unknown command."
+}
+
+func commandOptions(options []*discordgo.ApplicationCommandInteractionDataOption) map[string]string {
+	args := make(map[string]string)
+	for _, option := range options {
+		if value, ok := option.Value.(string); ok {
+			args[option.Name] = value
+		}
+	}
+	return args
+}
+
+// listStreams describes every stream announced in guildID and where there.
+func (a *App) listStreams(guildID string) string {
+	var b strings.Builder
+	for _, stream := range a.allStreams() {
+		targets := a.guildTargets(stream, guildID)
+		if len(targets) == 0 {
+			continue
+		}
+		for i, target := range targets {
+			targets[i] = "<#" + target + ">"
+		}
+		stream.withStream(func() {
+			status := ""
+			if stream.IsLive {
+				status = " (live)"
+			}
+			if stream.Unsubscribed {
+				status += " (not subscribed)"
+			}
+			fmt.Fprintf(&b, "**%v** [%v]%v: %v\n", stream.displayName(), streamTypeName(stream.Type), status, strings.Join(targets, ", "))
+		})
+	}
+	if b.Len() == 0 {
+		return "No streams are being announced here."
+	}
+	// Discord messages are capped at 2000 characters.
+	if b.Len() > 2000 {
+		return b.String()[:1997] + "..."
+	}
+	return b.String()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// TestCommandsStayInGuild checks that /paintbot list and remove only see the
+// channels of the server they are used in.
+func TestCommandsStayInGuild(t *testing.T) {
+	const guildA, guildB = "300000000000000001", "300000000000000002"
+	const channelA, channelB = "400000000000000001", "400000000000000002"
+
+	fake := newFakeServices(t)
+	fake.addUser("1", "streamer1")
+	fake.addUser("2", "streamer2")
+	fake.addChannel(channelA, guildA)
+	fake.addChannel(channelB, guildB)
+	a := startTestApp(t, fake, []*streamInfo{
+		{StreamName: "streamer1", UserId: "1", ColourString: "0x9146FF", Type: twitchType, Channels: []discordChannel{{ChannelID: channelA}, {ChannelID: channelB}}},
+		{StreamName: "streamer2", UserId: "2", ColourString: "0x9146FF", Type: twitchType, Channels: []discordChannel{{ChannelID: channelB}}},
+	}, nil)
+
+	command := func(guildID string, name string, args map[string]string) string {
+		sub := &discordgo.ApplicationCommandInteractionDataOption{Name: name, Type: discordgo.ApplicationCommandOptionSubCommand}
+		for k, v := range args {
+			sub.Options = append(sub.Options, &discordgo.ApplicationCommandInteractionDataOption{Name: k, Type: discordgo.ApplicationCommandOptionString, Value: v})
+		}
+		return a.runCommand(guildID, channelA, []*discordgo.ApplicationCommandInteractionDataOption{sub})
+	}
+
+	list := command(guildA, "list", nil)
+	if !strings.Contains(list, "streamer1") || !strings.Contains(list, "<#"+channelA+">") {
+		t.Errorf("list in A = %q, want streamer1 in <#%v>", list, channelA)
+	}
+	if strings.Contains(list, "streamer2") || strings.Contains(list, channelB) {
+		t.Errorf("list in A = %q, shows B's channel", list)
+	}
+
+	if reply := command(guildA, "remove", map[string]string{"type": "twitch", "name": "streamer2"}); !strings.HasPrefix(reply, "Could not remove") {
+		t.Errorf("removing B's stream from A = %q", reply)
+	}
+	if a.findChannel("streamer2", twitchType) == nil {
+		t.Fatal("A removed B's stream")
+	}
+
+	command(guildA, "remove", map[string]string{"type": "twitch", "name": "streamer1"})
+	stream := a.findChannel("streamer1", twitchType)
+	if stream == nil {
+		t.Fatal("removing streamer1 from A deleted it from B too")
+	}
+	if targets := a.guildTargets(stream, guildB); len(targets) != 1 || targets[0] != channelB {
+		t.Errorf("streamer1 is announced in %v in B, want only %v", targets, channelB)
+	}
+	if targets := a.guildTargets(stream, guildA); len(targets) != 0 {
+		t.Errorf("streamer1 is still announced in %v in A", targets)
+	}
+
+	command(guildB, "remove", map[string]string{"type": "twitch", "name": "streamer1"})
+	if a.findChannel("streamer1", twitchType) != nil {
+		t.Error("streamer1 is still tracked with no channels left")
+	}
+	for _, sub := range fake.currentSubscriptions() {
+		if sub.Condition["broadcaster_user_id"] == "1" {
+			t.Errorf("subscription %v for streamer1 was not deleted", sub.Type)
+		}
+	}
+}
+
+// TestPreviewStaysInGuild checks that /paintbot preview only shows streams,
+// and channels, of the server it is used in.
+func TestPreviewStaysInGuild(t *testing.T) {
+	const guildA, guildB = "300000000000000001", "300000000000000002"
+	const channelA, channelB = "400000000000000001", "400000000000000002"
+
+	fake := newFakeServices(t)
+	fake.addUser("1", "streamer1")
+	fake.addUser("2", "streamer2")
+	fake.addChannel(channelA, guildA)
+	fake.addChannel(channelB, guildB)
+	a := startTestApp(t, fake, []*streamInfo{
+		{StreamName: "streamer1", UserId: "1", ColourString: "0x9146FF", Type: twitchType, Channels: []discordChannel{{ChannelID: channelA}, {ChannelID: channelB}}},
+		{StreamName: "streamer2", UserId: "2", ColourString: "0x9146FF", Type: twitchType, Channels: []discordChannel{{ChannelID: channelB}}},
+	}, nil)
+
+	if edit := a.previewAnnouncement(guildA, "streamer2", channelA); edit.Embeds != nil || !strings.Contains(*edit.Content, "not announced here") {
+		t.Errorf("previewing B's stream from A = %q", *edit.Content)
+	}
+	if edit := a.previewAnnouncement(guildB, "streamer1", channelA); edit.Embeds != nil || !strings.Contains(*edit.Content, "not a channel in this server") {
+		t.Errorf("previewing A's channel from B = %q", *edit.Content)
+	}
+	if edit := a.previewAnnouncement(guildB, "streamer2", channelB); edit.Embeds == nil || len(*edit.Embeds) == 0 {
+		t.Errorf("previewing B's stream from B = %q, want an embed", *edit.Content)
+	}
+}
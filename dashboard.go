@@ -0,0 +1,300 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed templates
+var templateFiles embed.FS
+
+var dashboardTemplates = template.Must(template.ParseFS(templateFiles, "templates/*.html"))
+
+// dashboardStream is what the dashboard shows for one stream.
+type dashboardStream struct {
+	ID              int64
+	Name            string
+	Type            string
+	Live            bool
+	Subscription    string
+	LastOffline     string
+	Channels        []string
+	Shared          bool
+	Colour          string
+	Description     string
+	OfflineTime     int64
+	DisableOffline  bool
+	RefreshInterval int64
+	PostSummary     bool
+	AnnounceTypes   []dashboardOption
+}
+
+// dashboardOption is one checkbox of a setting with several values.
+type dashboardOption struct {
+	Value   string
+	Checked bool
+}
+
+type dashboardPage struct {
+	Session dashboardSession
+	CSRF    string
+	Notice  string
+	Streams []dashboardStream
+	Stream  dashboardStream
+}
+
+func (a *App) dashboardRoutes(handleFunc func(path string, handler Handler)) {
+	handleFunc("GET /dashboard/login", a.handleDashboardLogin)
+	handleFunc("GET /dashboard/callback", a.handleDashboardCallback)
+	handleFunc("POST /dashboard/logout", a.requireLogin(a.handleDashboardLogout))
+	handleFunc("GET /dashboard", a.requireLogin(a.handleDashboard))
+	handleFunc("POST /dashboard/streams", a.requireLogin(a.handleDashboardAdd))
+	handleFunc("GET /dashboard/streams/{id}", a.requireLogin(a.handleDashboardStream))
+	handleFunc("POST /dashboard/streams/{id}", a.requireLogin(a.handleDashboardUpdate))
+	handleFunc("POST /dashboard/streams/{id}/delete", a.requireLogin(a.handleDashboardDelete))
+}
+
+func (a *App) handleDashboard(w http.ResponseWriter, r *http.Request, session dashboardSession) error {
+	subscribed := a.subscribedEvents()
+	page := a.newDashboardPage(r, session)
+	for _, stream := range a.allStreams() {
+		if d := a.describeStream(stream, subscribed, session); len(d.Channels) > 0 {
+			page.Streams = append(page.Streams, d)
+		}
+	}
+	sort.Slice(page.Streams, func(i, j int) bool {
+		return strings.ToLower(page.Streams[i].Name) < strings.ToLower(page.Streams[j].Name)
+	})
+	return dashboardTemplates.ExecuteTemplate(w, "dashboard.html", page)
+}
+
+func (a *App) handleDashboardStream(w http.ResponseWriter, r *http.Request, session dashboardSession) error {
+	stream, _ := a.pathStream(r, session)
+	if stream == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	page := a.newDashboardPage(r, session)
+	page.Stream = a.describeStream(stream, a.subscribedEvents(), session)
+	return dashboardTemplates.ExecuteTemplate(w, "stream.html", page)
+}
+
+func (a *App) handleDashboardAdd(w http.ResponseWriter, r *http.Request, session dashboardSession) error {
+	name := r.PostFormValue("name")
+	channelID := strings.TrimSpace(r.PostFormValue("channel"))
+	if guildID, err := a.channelGuild(channelID); err != nil || !slices.Contains(session.Guilds, guildID) {
+		redirectWithNotice(w, r, "/dashboard", "Could not add "+name+": that channel is not in a server you manage.")
+		return nil
+	}
+
+	var stream *streamInfo
+	var err error
+	switch r.PostFormValue("type") {
+	case "twitch":
+		stream, err = a.addTwitchStream(name, channelID)
+	case "youtube":
+		stream, err = a.addYoutubeStream(name, r.PostFormValue("display_name"), channelID)
+	default:
+		http.Error(w, "Unknown stream type", http.StatusBadRequest)
+		return nil
+	}
+	if err != nil {
+		redirectWithNotice(w, r, "/dashboard", "Could not add "+name+": "+err.Error())
+		return nil
+	}
+	log.Printf("%v added %v to <#%v> from the dashboard\n", session.Username, stream.StreamName, channelID)
+	redirectWithNotice(w, r, "/dashboard", "Now announcing "+stream.StreamName+".")
+	return nil
+}
+
+func (a *App) handleDashboardUpdate(w http.ResponseWriter, r *http.Request, session dashboardSession) error {
+	stream, shared := a.pathStream(r, session)
+	if stream == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	path := "/dashboard/streams/" + r.PathValue("id")
+	if shared {
+		redirectWithNotice(w, r, path, "This stream is also announced in servers you do not manage, so its settings cannot be changed here.")
+		return nil
+	}
+
+	offlineTime, err := strconv.ParseInt(strings.TrimSpace(r.PostFormValue("offline_time")), 10, 64)
+	if err != nil {
+		redirectWithNotice(w, r, path, "Offline time must be a whole number of seconds.")
+		return nil
+	}
+	refreshInterval, err := strconv.ParseInt(strings.TrimSpace(r.PostFormValue("refresh_interval")), 10, 64)
+	if err != nil {
+		redirectWithNotice(w, r, path, "Refresh interval must be a whole number of seconds.")
+		return nil
+	}
+	err = a.updateStream(stream, streamSettings{
+		Colour:          strings.TrimSpace(r.PostFormValue("colour")),
+		Description:     r.PostFormValue("description"),
+		OfflineTime:     offlineTime,
+		DisableOffline:  r.PostFormValue("disable_offline") != "",
+		RefreshInterval: refreshInterval,
+		PostSummary:     r.PostFormValue("post_summary") != "",
+		AnnounceTypes:   r.PostForm["announce_types"],
+	})
+	if err != nil {
+		redirectWithNotice(w, r, path, "Could not save: "+err.Error())
+		return nil
+	}
+	log.Printf("%v updated %v from the dashboard\n", session.Username, stream.StreamName)
+	redirectWithNotice(w, r, path, "Saved.")
+	return nil
+}
+
+// handleDashboardDelete stops announcing the stream in the user's servers. It
+// is deleted once no other server announces it.
+func (a *App) handleDashboardDelete(w http.ResponseWriter, r *http.Request, session dashboardSession) error {
+	stream, _ := a.pathStream(r, session)
+	if stream == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err := a.removeStreamTarget(stream, a.guildTargets(stream, session.Guilds...)...); err != nil {
+		return err
+	}
+	log.Printf("%v removed %v from the dashboard\n", session.Username, stream.StreamName)
+	redirectWithNotice(w, r, "/dashboard", "No longer announcing "+stream.StreamName+" in your servers.")
+	return nil
+}
+
+func (a *App) newDashboardPage(r *http.Request, session dashboardSession) dashboardPage {
+	return dashboardPage{
+		Session: session,
+		CSRF:    a.csrfToken(session),
+		Notice:  r.URL.Query().Get("notice"),
+	}
+}
+
+// pathStream returns the stream named in the request's path, if it is announced
+// in one of the session's guilds, and whether it is announced elsewhere too.
+func (a *App) pathStream(r *http.Request, session dashboardSession) (*streamInfo, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	stream := a.findStream(id)
+	if stream == nil {
+		return nil, false
+	}
+	targets := a.guildTargets(stream, session.Guilds...)
+	if len(targets) == 0 {
+		return nil, false
+	}
+	var total int
+	stream.withStream(func() { total = len(stream.Channels) })
+	return stream, len(targets) < total
+}
+
+func redirectWithNotice(w http.ResponseWriter, r *http.Request, path string, notice string) {
+	http.Redirect(w, r, path+"?notice="+url.QueryEscape(notice), http.StatusSeeOther)
+}
+
+// subscribedEvents returns the enabled EventSub event types for each
+// broadcaster ID, or nil if Twitch could not be asked.
+func (a *App) subscribedEvents() map[string][]string {
+	subs, err := a.getSubscriptions("enabled")
+	if err != nil {
+		log.Printf("Could not list subscriptions: %v\n", err)
+		return nil
+	}
+	subscribed := make(map[string][]string)
+	for _, sub := range subs.Data {
+		userID := sub.Condition["broadcaster_user_id"]
+		subscribed[userID] = append(subscribed[userID], sub.Type)
+	}
+	return subscribed
+}
+
+// describeStream shows stream to the session's user, with only the channels
+// in their guilds.
+func (a *App) describeStream(stream *streamInfo, subscribed map[string][]string, session dashboardSession) dashboardStream {
+	targets := a.guildTargets(stream, session.Guilds...)
+	var d dashboardStream
+	stream.withStream(func() {
+		d = dashboardStream{
+			ID:              stream.ID,
+			Name:            stream.displayName(),
+			Type:            streamTypeName(stream.Type),
+			Live:            stream.IsLive,
+			LastOffline:     "never",
+			Colour:          stream.ColourString,
+			Description:     stream.Description,
+			OfflineTime:     stream.OfflineTime,
+			DisableOffline:  stream.DisableOffline,
+			RefreshInterval: stream.RefreshInterval,
+			PostSummary:     stream.PostSummary,
+		}
+		if stream.Type == twitchType {
+			for _, t := range twitchBroadcastTypes {
+				d.AnnounceTypes = append(d.AnnounceTypes, dashboardOption{t, slices.Contains(stream.AnnounceTypes, t)})
+			}
+		}
+		if stream.LastOffline > 0 {
+			d.LastOffline = time.Unix(stream.LastOffline, 0).Format("2 Jan 2006 15:04 MST")
+		}
+		for _, target := range targets {
+			d.Channels = append(d.Channels, a.channelName(target))
+		}
+		d.Shared = len(targets) < len(stream.Channels)
+
+		switch {
+		case stream.Type == youtubeType:
+			d.Subscription = "WebSub"
+		case stream.Unsubscribed:
+			d.Subscription = "revoked"
+		case subscribed == nil:
+			d.Subscription = "unknown"
+		default:
+			d.Subscription = subscriptionSummary(subscribed[stream.UserId])
+		}
+	})
+	return d
+}
+
+// subscriptionSummary describes which of the required event types a
+// broadcaster is subscribed to.
+func subscriptionSummary(types []string) string {
+	var missing []string
+	for _, required := range twitchEventTypes {
+		found := false
+		for _, t := range types {
+			if t == required {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, required)
+		}
+	}
+	switch len(missing) {
+	case 0:
+		return "enabled"
+	case len(twitchEventTypes):
+		return "not subscribed"
+	}
+	return "missing " + strings.Join(missing, ", ")
+}
+
+// channelName returns "#name" for a Discord channel the bot can see, or the
+// raw ID otherwise.
+func (a *App) channelName(channelID string) string {
+	if channel, err := a.discord.State.Channel(channelID); err == nil {
+		return "#" + channel.Name
+	}
+	return channelID
+}
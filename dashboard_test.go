@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDashboardSessionGuilds checks that a dashboard user only sees and
+// changes streams announced in the servers they manage.
+func TestDashboardSessionGuilds(t *testing.T) {
+	const guildA, guildB = "300000000000000001", "300000000000000002"
+	const channelA, channelB = "400000000000000001", "400000000000000002"
+
+	fake := newFakeServices(t)
+	fake.addUser("1", "streamer1")
+	fake.addUser("2", "streamer2")
+	fake.addChannel(channelA, guildA)
+	fake.addChannel(channelB, guildB)
+	a := startTestApp(t, fake, []*streamInfo{
+		{StreamName: "streamer1", UserId: "1", ColourString: "0x9146FF", Type: twitchType, Channels: []discordChannel{{ChannelID: channelA}, {ChannelID: channelB}}},
+		{StreamName: "streamer2", UserId: "2", ColourString: "0x9146FF", Type: twitchType, Channels: []discordChannel{{ChannelID: channelB}}},
+	}, nil)
+	shared, other := a.findChannel("streamer1", twitchType), a.findChannel("streamer2", twitchType)
+
+	session := dashboardSession{UserID: "500", Username: "manager", Guilds: []string{guildA}, Expires: time.Now().Add(time.Hour).Unix()}
+	recorder := httptest.NewRecorder()
+	a.setSession(recorder, session)
+	cookie := recorder.Result().Cookies()[0]
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	request := func(method string, path string, form url.Values) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://"+a.Addr().String()+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := request("GET", "/dashboard", nil)
+	if status != http.StatusOK || !strings.Contains(body, "streamer1") || strings.Contains(body, "streamer2") {
+		t.Errorf("dashboard = %v %q, want only streamer1", status, body)
+	}
+	if status, _ = request("GET", "/dashboard/streams/"+strconv.FormatInt(other.ID, 10), nil); status != http.StatusNotFound {
+		t.Errorf("another server's stream = %v, want 404", status)
+	}
+
+	csrf := url.Values{"csrf": {a.csrfToken(session)}}
+	update := url.Values{"csrf": csrf["csrf"], "colour": {"0x000000"}, "offline_time": {"0"}, "refresh_interval": {"0"}}
+	request("POST", "/dashboard/streams/"+strconv.FormatInt(shared.ID, 10), update)
+	shared.withStream(func() {
+		if shared.ColourString != "0x9146FF" {
+			t.Errorf("changed the colour of a stream shared with another server to %v", shared.ColourString)
+		}
+	})
+	if status, _ = request("POST", "/dashboard/streams/"+strconv.FormatInt(other.ID, 10)+"/delete", csrf); status != http.StatusNotFound {
+		t.Errorf("deleting another server's stream = %v, want 404", status)
+	}
+
+	request("POST", "/dashboard/streams/"+strconv.FormatInt(shared.ID, 10)+"/delete", csrf)
+	if !a.tracking(shared) || !a.tracking(other) {
+		t.Fatal("removing streamer1 from A deleted a stream B still announces")
+	}
+	if targets := a.guildTargets(shared, guildA, guildB); len(targets) != 1 || targets[0] != channelB {
+		t.Errorf("streamer1 is announced in %v, want only %v", targets, channelB)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	eventSubMessageIDHeader        = "Twitch-Eventsub-Message-Id"
+	eventSubMessageTimestampHeader = "Twitch-Eventsub-Message-Timestamp"
+	eventSubMessageSignatureHeader = "Twitch-Eventsub-Message-Signature"
+	eventSubMessageTypeHeader      = "Twitch-Eventsub-Message-Type"
+
+	eventSubSignaturePrefix = "sha256="
+	eventSubMaxMessageAge   = 10 * time.Minute
+)
+
+var (
+	errMissingEventSubHeaders = errors.New("eventsub message is missing signature headers")
+	errStaleEventSubMessage   = errors.New("eventsub message timestamp is too far from now")
+	errInvalidEventSubSig     = errors.New("eventsub message signature does not match")
+)
+
+// verifyEventSubMessage checks the HMAC signature Twitch attaches to every
+// EventSub webhook delivery against each of the given secrets, and rejects
+// messages whose timestamp is more than eventSubMaxMessageAge from now, in
+// either direction, so a future-dated delivery cannot be replayed later.
+func verifyEventSubMessage(header http.Header, body []byte, now time.Time, secrets ...string) error {
+	id := header.Get(eventSubMessageIDHeader)
+	timestamp := header.Get(eventSubMessageTimestampHeader)
+	signature := header.Get(eventSubMessageSignatureHeader)
+	if id == "" || timestamp == "" || signature == "" {
+		return errMissingEventSubHeaders
+	}
+
+	sent, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return err
+	}
+	if age := now.Sub(sent); age > eventSubMaxMessageAge || age < -eventSubMaxMessageAge {
+		return errStaleEventSubMessage
+	}
+
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(id))
+		mac.Write([]byte(timestamp))
+		mac.Write(body)
+		expected := eventSubSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+		if hmac.Equal([]byte(expected), []byte(signature)) {
+			return nil
+		}
+	}
+	return errInvalidEventSubSig
+}
+
+// generateEventSubSecret returns a random secret suitable for the EventSub
+// webhook transport, which accepts 10 to 100 ASCII characters.
+func generateEventSubSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ensureEventSubSecret makes sure the config holds a webhook secret, creating
+// one on first run or replacing it when rotate is set. The old secret is kept
+// so deliveries already in flight still verify, and subscriptions made with it
+// are replaced by reconcileSubscriptions before retirePreviousSecret forgets
+// it.
+func (a *App) ensureEventSubSecret(rotate bool) {
+	if a.config.Secrets.EventSubSecret != "" && !rotate {
+		return
+	}
+
+	a.config.Secrets.PreviousEventSubSecret = a.config.Secrets.EventSubSecret
+	a.config.Secrets.EventSubSecret = generateEventSubSecret()
+	a.config.Secrets.EventSubSecretCreated = time.Now().UTC().Format(time.RFC3339Nano)
+	a.writeConfig()
+	log.Println("Generated new EventSub secret")
+}
+
+// eventSubSecrets returns the current and previous EventSub secrets.
+func (a *App) eventSubSecrets() (string, string) {
+	a.configMu.Lock()
+	defer a.configMu.Unlock()
+	return a.config.Secrets.EventSubSecret, a.config.Secrets.PreviousEventSubSecret
+}
+
+// retirePreviousSecret forgets the previous EventSub secret once every message
+// signed with it is too old to be accepted anyway.
+func (a *App) retirePreviousSecret() {
+	select {
+	case <-time.After(eventSubMaxMessageAge):
+	case <-a.done:
+		return
+	}
+	a.configMu.Lock()
+	a.config.Secrets.PreviousEventSubSecret = ""
+	a.config.Secrets.EventSubSecretCreated = ""
+	a.configMu.Unlock()
+	a.writeConfig()
+	log.Println("Retired the previous EventSub secret")
+}
+
+// queueTwitchRevocation hands a revocation to the affected stream's event
+// queue. It reports false if the revocation could not be queued.
+func (a *App) queueTwitchRevocation(sub subscriptionInfo) bool {
+	userID := sub.Condition["broadcaster_user_id"]
+	log.Printf("Subscription %v (%v) for %v was revoked: %v\n", sub.ID, sub.Type, userID, sub.Status)
+
+	channel := a.findChannel(userID, twitchType)
+	if channel == nil {
+		log.Printf("No stream configured for %v, nothing to resubscribe\n", userID)
+		return true
+	}
+	if !channel.dispatch(func() {
+		a.handleTwitchRevocation(channel, sub)
+	}) {
+		log.Printf("Dropped revocation of %v for %v: its event queue is full or it was removed\n", sub.ID, userID)
+		return false
+	}
+	return true
+}
+
+// handleTwitchRevocation is called when Twitch stops sending events for a
+// subscription. Subscriptions dropped because our callback kept failing are
+// registered again; anything else needs an admin to look at it.
+func (a *App) handleTwitchRevocation(channel *streamInfo, sub subscriptionInfo) {
+	userID := sub.Condition["broadcaster_user_id"]
+	channel.Unsubscribed = true
+	a.saveStream(channel)
+
+	if sub.Status == "notification_failures_exceeded" {
+		err := a.registerTwitchSubscription(userID, sub.Type)
+		if err == nil {
+			channel.Unsubscribed = false
+			a.saveStream(channel)
+			log.Printf("Resubscribed to %v for %v\n", sub.Type, channel.StreamName)
+			return
+		}
+		log.Printf("Could not resubscribe to %v for %v: %v\n", sub.Type, channel.StreamName, err)
+	}
+
+	a.alertAdmin(fmt.Sprintf("Twitch revoked the %v subscription for %v (%v). Notifications for this stream are stopped until it is subscribed again.", sub.Type, channel.StreamName, sub.Status))
+}
+
+// alertAdmin posts a message to the configured admin channel, if there is one.
+func (a *App) alertAdmin(message string) {
+	if a.config.AdminChannelID == "" {
+		log.Println("No admin channel configured, alert not sent: " + message)
+		return
+	}
+
+	if _, err := a.discord.ChannelMessageSend(a.config.AdminChannelID, message); err != nil {
+		log.Printf("Could not alert admin: %v\n", err)
+	}
+}
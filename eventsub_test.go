@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyEventSubMessage(t *testing.T) {
+	const current, previous = "current-secret-0123", "previous-secret-0123"
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	body := []byte(`{"subscription":{"type":"stream.online"}}`)
+
+	signed := func(secret string, sent time.Time) http.Header {
+		timestamp := sent.Format(time.RFC3339Nano)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("message-1" + timestamp))
+		mac.Write(body)
+		header := http.Header{}
+		header.Set(eventSubMessageIDHeader, "message-1")
+		header.Set(eventSubMessageTimestampHeader, timestamp)
+		header.Set(eventSubMessageSignatureHeader, eventSubSignaturePrefix+hex.EncodeToString(mac.Sum(nil)))
+		return header
+	}
+	without := func(name string) http.Header {
+		header := signed(current, now)
+		header.Del(name)
+		return header
+	}
+
+	tests := []struct {
+		name    string
+		header  http.Header
+		secrets []string
+		wantErr error
+	}{
+		{name: "good signature", header: signed(current, now), secrets: []string{current, previous}},
+		{name: "recent", header: signed(current, now.Add(-eventSubMaxMessageAge+time.Second)), secrets: []string{current}},
+		{name: "bad signature", header: signed("someone-else-0123", now), secrets: []string{current, previous}, wantErr: errInvalidEventSubSig},
+		{name: "previous secret", header: signed(previous, now), secrets: []string{current, previous}},
+		{name: "previous secret retired", header: signed(previous, now), secrets: []string{current, ""}, wantErr: errInvalidEventSubSig},
+		{name: "missing id", header: without(eventSubMessageIDHeader), secrets: []string{current}, wantErr: errMissingEventSubHeaders},
+		{name: "missing timestamp", header: without(eventSubMessageTimestampHeader), secrets: []string{current}, wantErr: errMissingEventSubHeaders},
+		{name: "missing signature", header: without(eventSubMessageSignatureHeader), secrets: []string{current}, wantErr: errMissingEventSubHeaders},
+		{name: "stale", header: signed(current, now.Add(-eventSubMaxMessageAge-time.Second)), secrets: []string{current}, wantErr: errStaleEventSubMessage},
+		{name: "future", header: signed(current, now.Add(eventSubMaxMessageAge+time.Second)), secrets: []string{current}, wantErr: errStaleEventSubMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyEventSubMessage(tt.header, body, now, tt.secrets...)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("verifyEventSubMessage() = %v, want nil", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("verifyEventSubMessage() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestPreviousSecretSubscriptionsReplaced checks that after a secret rotation
+// only the webhook subscriptions made with the previous secret are recreated,
+// and that nothing is recreated once they all use the current one.
+func TestPreviousSecretSubscriptionsReplaced(t *testing.T) {
+	fake := newFakeServices(t)
+	fake.addUser("1", "streamer1")
+	rotated := time.Now().Add(-time.Minute)
+	webhook := map[string]string{"method": webhookTransport, "callback": "https://paintbot.example.com/notify"}
+	fake.mu.Lock()
+	for i, eventType := range twitchEventTypes {
+		created := rotated.Add(time.Second)
+		if eventType == "stream.online" {
+			created = rotated.Add(-time.Hour)
+		}
+		fake.subscriptions = append(fake.subscriptions, subscriptionInfo{
+			ID:        fmt.Sprintf("existing-%d", i),
+			Status:    "enabled",
+			Type:      eventType,
+			Condition: map[string]string{"broadcaster_user_id": "1"},
+			Transport: webhook,
+			CreatedAt: created.UTC().Format(time.RFC3339Nano),
+		})
+	}
+	fake.mu.Unlock()
+
+	a := startTestApp(t, fake, []*streamInfo{{
+		StreamName:   "streamer1",
+		UserId:       "1",
+		ColourString: "0x9146FF",
+		Type:         twitchType,
+		Channels:     []discordChannel{{ChannelID: "201"}},
+	}}, func(cfg *cofiguration) {
+		cfg.Secrets.PreviousEventSubSecret = "previous-secret-0123"
+		cfg.Secrets.EventSubSecretCreated = rotated.UTC().Format(time.RFC3339Nano)
+	})
+
+	ids := func() map[string]string {
+		ids := make(map[string]string)
+		for _, sub := range fake.currentSubscriptions() {
+			ids[sub.Type] = sub.ID
+		}
+		return ids
+	}
+	after := ids()
+	if len(after) != len(twitchEventTypes) || len(fake.currentSubscriptions()) != len(twitchEventTypes) {
+		t.Fatalf("subscriptions after start = %v", fake.currentSubscriptions())
+	}
+	if id := after["stream.online"]; id == "existing-0" {
+		t.Error("the stream.online subscription made with the previous secret was kept")
+	}
+	if after["stream.offline"] != "existing-1" || after["channel.update"] != "existing-2" {
+		t.Errorf("subscriptions made with the current secret were recreated: %v", after)
+	}
+
+	if !a.reconcileSubscriptions() {
+		t.Error("reconcile reports subscriptions missing")
+	}
+	if again := ids(); !maps.Equal(after, again) {
+		t.Errorf("a second reconcile recreated subscriptions: %v, then %v", after, again)
+	}
+}
+
+// TestRevocation checks that revocations reach their stream: one dropped for
+// failed deliveries is subscribed again, and anything else stops the stream
+// and alerts the admin channel.
+func TestRevocation(t *testing.T) {
+	const adminChannel = "900"
+	fake := newFakeServices(t)
+	fake.addUser("1", "streamer1")
+	a := startTestApp(t, fake, []*streamInfo{{
+		StreamName:   "streamer1",
+		UserId:       "1",
+		ColourString: "0x9146FF",
+		Type:         twitchType,
+		Channels:     []discordChannel{{ChannelID: "201"}},
+	}}, func(cfg *cofiguration) {
+		cfg.AdminChannelID = adminChannel
+	})
+	stream := a.findChannel("1", twitchType)
+
+	// Twitch deletes a subscription when it revokes it.
+	revoke := func(messageID string, eventType string, status string) {
+		t.Helper()
+		var revoked subscriptionInfo
+		fake.mu.Lock()
+		for i, sub := range fake.subscriptions {
+			if sub.Type == eventType && sub.Condition["broadcaster_user_id"] == "1" {
+				revoked = sub
+				fake.subscriptions = slices.Delete(fake.subscriptions, i, i+1)
+				break
+			}
+		}
+		fake.mu.Unlock()
+		revoked.Status = status
+		if got := sendEventSub(t, a, messageID, "revocation", map[string]any{"subscription": revoked}); got != http.StatusNoContent {
+			t.Fatalf("revocation returned %v", got)
+		}
+	}
+	subscribed := func(eventType string) bool {
+		for _, sub := range fake.currentSubscriptions() {
+			if sub.Type == eventType && sub.Condition["broadcaster_user_id"] == "1" {
+				return true
+			}
+		}
+		return false
+	}
+	unsubscribed := func() bool {
+		var unsubscribed bool
+		stream.withStream(func() { unsubscribed = stream.Unsubscribed })
+		return unsubscribed
+	}
+	adminAlerts := func() []fakeMessage {
+		return slices.DeleteFunc(fake.sentMessages(), func(m fakeMessage) bool { return m.ChannelID != adminChannel })
+	}
+
+	revoke("revoke-1", "stream.online", "notification_failures_exceeded")
+	eventually(t, "the resubscription", func() bool { return subscribed("stream.online") })
+	drained := make(chan struct{})
+	stream.dispatch(func() { close(drained) })
+	<-drained
+	if unsubscribed() {
+		t.Error("the stream is marked unsubscribed after resubscribing")
+	}
+	if alerts := adminAlerts(); len(alerts) != 0 {
+		t.Errorf("admin alerted about a resubscribed revocation: %q", alerts[0].Content)
+	}
+
+	revoke("revoke-2", "channel.update", "authorization_revoked")
+	eventually(t, "the admin alert", func() bool { return len(adminAlerts()) == 1 })
+	if alert := adminAlerts()[0].Content; !strings.Contains(alert, "channel.update") || !strings.Contains(alert, "authorization_revoked") {
+		t.Errorf("admin alert = %q", alert)
+	}
+	if !unsubscribed() {
+		t.Error("the stream is not marked unsubscribed")
+	}
+	if subscribed("channel.update") {
+		t.Error("resubscribed after the broadcaster revoked authorisation")
+	}
+
+	// A revocation for a broadcaster we do not track is acknowledged and
+	// otherwise ignored.
+	other := twitchEvent("stream.online", "2", "stranger", nil).SubscriptionInfo
+	other.Status = "authorization_revoked"
+	if got := sendEventSub(t, a, "revoke-3", "revocation", map[string]any{"subscription": other}); got != http.StatusNoContent {
+		t.Fatalf("revocation returned %v", got)
+	}
+	if alerts := adminAlerts(); len(alerts) != 1 {
+		t.Errorf("%v admin alerts after an untracked revocation, want 1", len(alerts))
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/oauth2"
+)
+
+const (
+	webhookTransport   string = "webhook"
+	websocketTransport string = "websocket"
+
+	// eventSubWelcomeTimeout is how long Twitch has to welcome a new
+	// connection, and eventSubKeepaliveGrace how long past the session's
+	// keepalive timeout we wait for a message before giving up on it.
+	eventSubWelcomeTimeout = 10 * time.Second
+	eventSubKeepaliveGrace = 5 * time.Second
+
+	eventSubMinBackoff = time.Second
+	eventSubMaxBackoff = 2 * time.Minute
+	// eventSubStableSession is how long a session has to last for the next
+	// connection attempt to be made straight away.
+	eventSubStableSession = time.Minute
+)
+
+var (
+	errNoEventSubSession = errors.New("not connected to the EventSub WebSocket yet")
+	errEventSubClosed    = errors.New("shutting down")
+)
+
+// eventSubMessage is one message on the EventSub WebSocket. Payload depends on
+// the message type.
+type eventSubMessage struct {
+	Metadata struct {
+		MessageID        string `json:"message_id"`
+		MessageType      string `json:"message_type"`
+		MessageTimestamp string `json:"message_timestamp"`
+	} `json:"metadata"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// eventSubSessionPayload is the payload of session_welcome and
+// session_reconnect messages.
+type eventSubSessionPayload struct {
+	Session struct {
+		ID                      string `json:"id"`
+		Status                  string `json:"status"`
+		KeepaliveTimeoutSeconds int    `json:"keepalive_timeout_seconds"`
+		ReconnectURL            string `json:"reconnect_url"`
+	} `json:"session"`
+}
+
+// eventSubConn is one welcomed connection to the EventSub WebSocket. Its
+// messages are read in the background until it fails or is closed.
+type eventSubConn struct {
+	conn      *websocket.Conn
+	sessionID string
+	keepalive time.Duration
+
+	messages chan eventSubMessage
+	err      error
+	done     chan struct{}
+}
+
+// eventSubSession returns the ID of the current WebSocket session, or "" when
+// not connected.
+func (a *App) eventSubSession() string {
+	a.sessionMu.RLock()
+	defer a.sessionMu.RUnlock()
+	return a.eventSubSessionID
+}
+
+func (a *App) setEventSubSession(id string) {
+	a.sessionMu.Lock()
+	a.eventSubSessionID = id
+	a.sessionMu.Unlock()
+}
+
+// runEventSubWebSocket keeps a session open with the EventSub WebSocket until
+// the App is closed. Every new session is subscribed to straight away;
+// sessions Twitch moves us to with session_reconnect keep their
+// subscriptions.
+func (a *App) runEventSubWebSocket() {
+	var conn *eventSubConn
+	backoff := eventSubMinBackoff
+	for {
+		if conn == nil {
+			var err error
+			conn, err = a.dialEventSub(a.config.Endpoints.TwitchEventSubWS)
+			if err != nil {
+				log.Printf("Could not connect to the EventSub WebSocket, retrying in %v: %v\n", backoff, err)
+				select {
+				case <-time.After(backoff):
+				case <-a.done:
+					return
+				}
+				backoff = min(backoff*2, eventSubMaxBackoff)
+				continue
+			}
+			log.Printf("EventSub WebSocket session %v started\n", conn.sessionID)
+			a.setEventSubSession(conn.sessionID)
+			go a.subscribeSession(conn.sessionID)
+		}
+
+		connected := time.Now()
+		next, err := a.readEventSub(conn)
+		conn.close()
+		if next != nil {
+			log.Printf("EventSub WebSocket session moved to %v\n", next.sessionID)
+			a.setEventSubSession(next.sessionID)
+			conn = next
+			continue
+		}
+
+		a.setEventSubSession("")
+		conn = nil
+		if errors.Is(err, errEventSubClosed) {
+			return
+		}
+		log.Printf("EventSub WebSocket session ended: %v\n", err)
+		if time.Since(connected) > eventSubStableSession {
+			backoff = eventSubMinBackoff
+			continue
+		}
+		select {
+		case <-time.After(backoff):
+		case <-a.done:
+			return
+		}
+		backoff = min(backoff*2, eventSubMaxBackoff)
+	}
+}
+
+// dialEventSub connects to url and waits for Twitch's welcome.
+func (a *App) dialEventSub(url string) (*eventSubConn, error) {
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: eventSubWelcomeTimeout,
+	}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(eventSubWelcomeTimeout))
+	var welcome eventSubMessage
+	var session eventSubSessionPayload
+	if err = conn.ReadJSON(&welcome); err == nil {
+		err = json.Unmarshal(welcome.Payload, &session)
+	}
+	if err == nil && (welcome.Metadata.MessageType != "session_welcome" || session.Session.ID == "") {
+		err = fmt.Errorf("expected session_welcome, got %q", welcome.Metadata.MessageType)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &eventSubConn{
+		conn:      conn,
+		sessionID: session.Session.ID,
+		keepalive: time.Duration(session.Session.KeepaliveTimeoutSeconds)*time.Second + eventSubKeepaliveGrace,
+		messages:  make(chan eventSubMessage),
+		done:      make(chan struct{}),
+	}
+	go c.read()
+	return c, nil
+}
+
+// read hands messages to c.messages until the connection fails, including by
+// going quiet for longer than the keepalive timeout.
+func (c *eventSubConn) read() {
+	defer close(c.messages)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.keepalive))
+		var msg eventSubMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.err = err
+			return
+		}
+		select {
+		case c.messages <- msg:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *eventSubConn) close() {
+	close(c.done)
+	c.conn.Close()
+}
+
+// readEventSub handles messages on conn until it ends. If Twitch asks us to
+// reconnect elsewhere, the new connection is returned once it is welcomed;
+// until then messages keep being read from the old one.
+func (a *App) readEventSub(conn *eventSubConn) (*eventSubConn, error) {
+	var reconnected chan *eventSubConn
+	for {
+		select {
+		case <-a.done:
+			if reconnected != nil {
+				if next := <-reconnected; next != nil {
+					next.close()
+				}
+			}
+			return nil, errEventSubClosed
+
+		case next := <-reconnected:
+			if next != nil {
+				return next, nil
+			}
+			reconnected = nil
+
+		case msg, ok := <-conn.messages:
+			if !ok {
+				if reconnected != nil {
+					if next := <-reconnected; next != nil {
+						return next, nil
+					}
+				}
+				return nil, conn.err
+			}
+
+			switch msg.Metadata.MessageType {
+			case "session_keepalive":
+			case "session_reconnect":
+				var session eventSubSessionPayload
+				if err := json.Unmarshal(msg.Payload, &session); err != nil || reconnected != nil {
+					continue
+				}
+				reconnected = make(chan *eventSubConn, 1)
+				go func(url string) {
+					next, err := a.dialEventSub(url)
+					if err != nil {
+						log.Printf("Could not reconnect to the EventSub WebSocket: %v\n", err)
+					}
+					reconnected <- next
+				}(session.Session.ReconnectURL)
+			default:
+				a.handleEventSubMessage(msg.Metadata.MessageID, msg.Metadata.MessageType, msg.Payload)
+			}
+		}
+	}
+}
+
+// userToken returns the user access token WebSocket subscriptions are managed
+// with.
+func (a *App) userToken() string {
+	a.tokenMu.RLock()
+	defer a.tokenMu.RUnlock()
+	return a.config.Secrets.TwitchUserToken
+}
+
+// refreshUserToken swaps the refresh token for a new user access token and
+// saves both to the config.
+func (a *App) refreshUserToken() error {
+	config := &oauth2.Config{
+		ClientID:     a.config.Secrets.TwitchClientID,
+		ClientSecret: a.config.Secrets.TwitchClientSecret,
+		Endpoint: oauth2.Endpoint{
+			TokenURL:  a.config.Endpoints.TwitchAuth + "/token",
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, a.client)
+
+	a.tokenMu.Lock()
+	refreshToken := a.config.Secrets.TwitchRefreshToken
+	if refreshToken == "" {
+		a.tokenMu.Unlock()
+		return errors.New("the Twitch user token was rejected and there is no refresh token to renew it")
+	}
+	expired := &oauth2.Token{RefreshToken: refreshToken, Expiry: time.Unix(1, 0)}
+	token, err := config.TokenSource(ctx, expired).Token()
+	if err == nil {
+		a.configMu.Lock()
+		a.config.Secrets.TwitchUserToken = token.AccessToken
+		if token.RefreshToken != "" {
+			a.config.Secrets.TwitchRefreshToken = token.RefreshToken
+		}
+		a.configMu.Unlock()
+	}
+	a.tokenMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("refreshing the Twitch user token: %w", err)
+	}
+	log.Println("Refreshed Twitch user token")
+	a.writeConfig()
+	return nil
+}
+
+// subscriptionRequest calls the EventSub subscriptions API. Webhook
+// subscriptions are managed with the app access token; WebSocket ones only
+// with a user access token, which is refreshed and the request retried once
+// if Twitch rejects it.
+func (a *App) subscriptionRequest(method string, url string, body []byte) (*http.Response, error) {
+	if a.config.EventSubTransport != websocketTransport {
+		return a.helix.do(method, url, body)
+	}
+	for attempt := 0; ; attempt++ {
+		req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+		req.Header.Add("Client-ID", a.config.Secrets.TwitchClientID)
+		req.Header.Add("Authorization", "Bearer "+a.userToken())
+		if body != nil {
+			req.Header.Add("Content-type", "application/json")
+		}
+
+		resp, err := a.client.Do(req)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, err
+		}
+		resp.Body.Close()
+		if err = a.refreshUserToken(); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeEventSub is a stand-in for Twitch's EventSub WebSocket. Every connection
+// is welcomed with a new session and then handed to the test to drive.
+type fakeEventSub struct {
+	server *httptest.Server
+	conns  chan *fakeEventSubConn
+
+	mu        sync.Mutex
+	sessions  int
+	keepalive int
+}
+
+type fakeEventSubConn struct {
+	conn      *websocket.Conn
+	sessionID string
+	closed    chan struct{}
+}
+
+func newFakeEventSub(t *testing.T, keepalive int) *fakeEventSub {
+	f := &fakeEventSub{conns: make(chan *fakeEventSubConn, 10), keepalive: keepalive}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.sessions++
+		c := &fakeEventSubConn{conn: conn, sessionID: fmt.Sprintf("session-%d", f.sessions), closed: make(chan struct{})}
+		keepalive := f.keepalive
+		f.mu.Unlock()
+
+		c.send("session_welcome", map[string]any{"session": map[string]any{
+			"id":                        c.sessionID,
+			"status":                    "connected",
+			"keepalive_timeout_seconds": keepalive,
+		}})
+		f.conns <- c
+		// Nothing is read from the bot; this only notices it hanging up.
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(c.closed)
+				return
+			}
+		}
+	}))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// setKeepalive changes the keepalive timeout, in seconds, that new sessions
+// are welcomed with.
+func (f *fakeEventSub) setKeepalive(seconds int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keepalive = seconds
+}
+
+func (f *fakeEventSub) url() string {
+	return "ws" + strings.TrimPrefix(f.server.URL, "http")
+}
+
+// next waits for the bot's next connection.
+func (f *fakeEventSub) next(t *testing.T, timeout time.Duration) *fakeEventSubConn {
+	t.Helper()
+	select {
+	case c := <-f.conns:
+		return c
+	case <-time.After(timeout):
+		t.Fatal("the bot did not connect to the EventSub WebSocket")
+		return nil
+	}
+}
+
+func (c *fakeEventSubConn) send(messageType string, payload any) {
+	body, _ := json.Marshal(payload)
+	c.conn.WriteJSON(map[string]any{
+		"metadata": map[string]any{
+			"message_id":        fmt.Sprintf("%v-%d", c.sessionID, time.Now().UnixNano()),
+			"message_type":      messageType,
+			"message_timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+		},
+		"payload": json.RawMessage(body),
+	})
+}
+
+// TestEventSubWebSocket follows a WebSocket session through its welcome, a
+// notification, a revocation, a session_reconnect handover and a connection
+// that goes quiet past its keepalive timeout.
+func TestEventSubWebSocket(t *testing.T) {
+	fake := newFakeServices(t)
+	fake.addUser("1", "streamer1")
+	eventSub := newFakeEventSub(t, 60)
+	// Left over from when the bot used webhooks.
+	fake.mu.Lock()
+	fake.subscriptions = append(fake.subscriptions, subscriptionInfo{
+		ID:        "old-webhook",
+		Status:    "enabled",
+		Type:      "stream.online",
+		Condition: map[string]string{"broadcaster_user_id": "1"},
+		Transport: map[string]string{"method": webhookTransport, "callback": "https://paintbot.example.com/notify"},
+	})
+	fake.mu.Unlock()
+	a := startTestApp(t, fake, []*streamInfo{{
+		StreamName:   "streamer1",
+		UserId:       "1",
+		ColourString: "0x9146FF",
+		Type:         twitchType,
+		Channels:     []discordChannel{{ChannelID: "201"}},
+	}}, func(cfg *cofiguration) {
+		cfg.EventSubTransport = websocketTransport
+		cfg.Secrets.TwitchUserToken = "user-token"
+		cfg.Endpoints.TwitchEventSubWS = eventSub.url()
+	})
+
+	// Welcome: the new session gets every subscription, and the webhook one is
+	// deleted.
+	first := eventSub.next(t, 5*time.Second)
+	eventually(t, "subscriptions for the first session", func() bool {
+		subs := fake.currentSubscriptions()
+		for _, sub := range subs {
+			if sub.Transport["method"] != websocketTransport || sub.Transport["session_id"] != first.sessionID {
+				return false
+			}
+		}
+		return len(subs) == len(twitchEventTypes)
+	})
+	if got := a.eventSubSession(); got != first.sessionID {
+		t.Errorf("session = %q, want %q", got, first.sessionID)
+	}
+
+	// Notifications and revocations are routed to the stream.
+	first.send("notification", twitchEvent("stream.online", "1", "streamer1", map[string]any{
+		"id":         "stream-1",
+		"type":       "live",
+		"started_at": time.Now().UTC().Format(time.RFC3339),
+	}))
+	eventually(t, "the announcement", func() bool { return len(fake.sentMessages()) == 1 })
+
+	revoked := twitchEvent("channel.update", "1", "streamer1", nil)
+	revoked.SubscriptionInfo.Status = "authorization_revoked"
+	first.send("revocation", map[string]any{"subscription": revoked.SubscriptionInfo})
+	stream := a.findChannel("1", twitchType)
+	eventually(t, "the revocation", func() bool {
+		var unsubscribed bool
+		stream.withStream(func() { unsubscribed = stream.Unsubscribed })
+		return unsubscribed
+	})
+
+	// session_reconnect: the bot moves to the new session, hangs up the old
+	// one and keeps its subscriptions.
+	subscribed := len(fake.currentSubscriptions())
+	eventSub.setKeepalive(1)
+	first.send("session_reconnect", map[string]any{"session": map[string]any{
+		"id":            first.sessionID,
+		"status":        "reconnecting",
+		"reconnect_url": eventSub.url(),
+	}})
+	second := eventSub.next(t, 5*time.Second)
+	eventually(t, "the move to the new session", func() bool { return a.eventSubSession() == second.sessionID })
+	select {
+	case <-first.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("the old session was not closed")
+	}
+	if got := len(fake.currentSubscriptions()); got != subscribed {
+		t.Errorf("%v subscriptions after the handover, want %v", got, subscribed)
+	}
+
+	// Keepalive timeout: the second session never sends anything, so the bot
+	// gives up on it and starts a new session, which is subscribed to even
+	// while a reconcile is stuck.
+	a.reconcileMu.Lock()
+	defer a.reconcileMu.Unlock()
+	third := eventSub.next(t, time.Second+eventSubKeepaliveGrace+eventSubMinBackoff+5*time.Second)
+	if third.sessionID == second.sessionID {
+		t.Fatal("reconnected to the same session")
+	}
+	eventually(t, "subscriptions for the new session", func() bool {
+		for _, sub := range fake.currentSubscriptions() {
+			if sub.Transport["session_id"] == third.sessionID {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// channelFilter limits which broadcasts are announced in one Discord channel.
+// Games match a category's Twitch ID or, ignoring case, its name. Titles
+// match a keyword found anywhere in the title, ignoring case, or a regular
+// expression written between slashes, like /speed ?run/. An empty list
+// allows everything.
+type channelFilter struct {
+	Games         []string `json:"games,omitempty"`
+	ExcludeGames  []string `json:"exclude_games,omitempty"`
+	Titles        []string `json:"titles,omitempty"`
+	ExcludeTitles []string `json:"exclude_titles,omitempty"`
+}
+
+// allows reports whether a broadcast of game with title is announced. A nil
+// filter allows everything.
+func (f *channelFilter) allows(game twitchGame, title string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Games) > 0 && !matchesGame(f.Games, game) {
+		return false
+	}
+	if len(f.Titles) > 0 && !matchesTitle(f.Titles, title) {
+		return false
+	}
+	return !matchesGame(f.ExcludeGames, game) && !matchesTitle(f.ExcludeTitles, title)
+}
+
+// validate checks that no rule is empty and every regular expression
+// compiles.
+func (f *channelFilter) validate() error {
+	for _, games := range [][]string{f.Games, f.ExcludeGames} {
+		for _, game := range games {
+			if strings.TrimSpace(game) == "" {
+				return inputError("game filters cannot be empty")
+			}
+		}
+	}
+	for _, titles := range [][]string{f.Titles, f.ExcludeTitles} {
+		for _, rule := range titles {
+			if strings.TrimSpace(rule) == "" {
+				return inputError("title filters cannot be empty")
+			}
+			if pattern, ok := titlePattern(rule); ok {
+				if _, err := regexp.Compile(pattern); err != nil {
+					return inputError(fmt.Sprintf("title filter %v is not a valid regular expression: %v", rule, err))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func matchesGame(games []string, game twitchGame) bool {
+	for _, g := range games {
+		g = strings.TrimSpace(g)
+		if (game.ID != "" && g == game.ID) || strings.EqualFold(g, game.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesTitle(rules []string, title string) bool {
+	for _, rule := range rules {
+		if pattern, ok := titlePattern(rule); ok {
+			// Patterns were checked by validate.
+			if re, err := regexp.Compile(pattern); err == nil && re.MatchString(title) {
+				return true
+			}
+		} else if strings.Contains(strings.ToLower(title), strings.ToLower(strings.TrimSpace(rule))) {
+			return true
+		}
+	}
+	return false
+}
+
+// titlePattern returns the regular expression in a title rule written
+// between slashes.
+func titlePattern(rule string) (string, bool) {
+	if len(rule) > 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") {
+		return rule[1 : len(rule)-1], true
+	}
+	return "", false
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// helixBatchSize is the most users, channels or games Helix looks up in
+	// one request.
+	helixBatchSize = 100
+
+	// How long looked up users, channels and games are cached. Channels are
+	// kept briefly since their title is what changes mid-stream.
+	helixUserTTL    = time.Hour
+	helixChannelTTL = time.Minute
+	helixGameTTL    = 24 * time.Hour
+)
+
+// ErrNotFound is returned by the Helix client when Twitch has no such user,
+// channel or game, whether it answered 404 or with an empty list.
+var ErrNotFound = errors.New("not found on Twitch")
+
+// helixError is the body Twitch sends with a failed Helix request.
+type helixError struct {
+	Status  int    `json:"status"`
+	Title   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func (e *helixError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("helix returned %v %v", e.Status, e.Title)
+	}
+	return fmt.Sprintf("helix returned %v %v: %v", e.Status, e.Title, e.Message)
+}
+
+func (e *helixError) Is(target error) bool {
+	return target == ErrNotFound && e.Status == http.StatusNotFound
+}
+
+// helixResponseError returns the error for a non-2xx Helix response, given
+// its body, or nil for a successful one.
+func helixResponseError(resp *http.Response, body []byte) error {
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	e := &helixError{}
+	if json.Unmarshal(body, e) != nil || e.Status == 0 {
+		e = &helixError{Title: http.StatusText(resp.StatusCode), Message: string(bytes.TrimSpace(body))}
+	}
+	e.Status = resp.StatusCode
+	return e
+}
+
+// helixClient makes requests to the Twitch Helix API with the app access
+// token.
+type helixClient struct {
+	baseURL  string
+	clientID string
+	client   *http.Client
+	token    *appTokenSource
+
+	limiter *helixLimiter
+	stats   helixStats
+	done    <-chan struct{}
+
+	userLogins *ttlCache[twitchUser]
+	userIDs    *ttlCache[twitchUser]
+	channels   *ttlCache[twitchChannel]
+	games      *ttlCache[twitchGame]
+}
+
+func (a *App) newHelixClient() *helixClient {
+	return &helixClient{
+		baseURL:  a.config.Endpoints.TwitchAPI,
+		clientID: a.config.Secrets.TwitchClientID,
+		client:   a.client,
+		token:    a.appToken,
+		limiter:  newHelixLimiter(),
+		done:     a.done,
+
+		userLogins: newTTLCache[twitchUser](helixUserTTL),
+		userIDs:    newTTLCache[twitchUser](helixUserTTL),
+		channels:   newTTLCache[twitchChannel](helixChannelTTL),
+		games:      newTTLCache[twitchGame](helixGameTTL),
+	}
+}
+
+// do makes a Helix request to url. Requests wait their turn in the rate
+// limiter; if Twitch rejects the token it is replaced and the request retried,
+// and GETs and DELETEs are also retried after a 429, 5xx or network error.
+func (h *helixClient) do(method string, url string, body []byte) (*http.Response, error) {
+	idempotent := method == "GET" || method == "DELETE"
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		waited, err := h.limiter.take(h.done)
+		if waited {
+			h.stats.throttled.Add(1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		token, err := h.token.Token()
+		if err != nil {
+			h.stats.failed.Add(1)
+			return nil, err
+		}
+		req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+		req.Header.Add("Client-ID", h.clientID)
+		req.Header.Add("Authorization", "Bearer "+token.AccessToken)
+		if body != nil {
+			req.Header.Add("Content-type", "application/json")
+		}
+
+		h.stats.requests.Add(1)
+		resp, err := h.client.Do(req)
+		if err == nil {
+			h.limiter.update(resp.Header)
+		}
+		switch {
+		case err == nil && resp.StatusCode == http.StatusUnauthorized && !refreshed:
+			resp.Body.Close()
+			log.Println("Twitch rejected the app access token, getting a new one")
+			h.token.invalidate(token.AccessToken)
+			refreshed = true
+			attempt--
+			continue
+		case err == nil && resp.StatusCode == http.StatusTooManyRequests:
+			h.stats.throttled.Add(1)
+			h.limiter.exhaust()
+		case err == nil && resp.StatusCode < 500:
+			return resp, nil
+		}
+
+		// Rate limited, a server error or no response at all.
+		if !idempotent || attempt >= helixMaxRetries {
+			if err != nil || resp.StatusCode >= 500 {
+				h.stats.failed.Add(1)
+			}
+			return resp, err
+		}
+		var retry string
+		if err != nil {
+			retry = err.Error()
+		} else {
+			retry = resp.Status
+			resp.Body.Close()
+		}
+		h.stats.retries.Add(1)
+		if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+			backoff := retryBackoff(attempt)
+			log.Printf("Helix %v %v failed (%v), retrying in %v\n", method, req.URL.Path, retry, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-h.done:
+				return nil, errHelixClosed
+			}
+		} else {
+			log.Printf("Helix %v %v was rate limited, retrying after the reset\n", method, req.URL.Path)
+		}
+	}
+}
+
+// get fetches path with query from Helix and decodes the response into v.
+func (h *helixClient) get(path string, query url.Values, v any) error {
+	resp, err := h.do("GET", h.baseURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err = helixResponseError(resp, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// lookup returns the values for keys, taking what it can from cache, if
+// there is one, and fetching the rest from path, helixBatchSize at a time,
+// with one param per key and anything in query. The result is indexed by
+// keyOf; keys Twitch does not know are missing from it.
+func lookup[T any](h *helixClient, cache *ttlCache[T], path string, query url.Values, param string, keys []string, keyOf func(T) string) (map[string]T, error) {
+	found := make(map[string]T, len(keys))
+	var missing []string
+	for _, key := range keys {
+		if _, ok := found[key]; ok || key == "" {
+			continue
+		}
+		if cache != nil {
+			if v, ok := cache.get(key); ok {
+				found[key] = v
+				continue
+			}
+		}
+		if !slices.Contains(missing, key) {
+			missing = append(missing, key)
+		}
+	}
+
+	for batch := range slices.Chunk(missing, helixBatchSize) {
+		var page struct {
+			Data []T `json:"data"`
+		}
+		batchQuery := maps.Clone(query)
+		if batchQuery == nil {
+			batchQuery = make(url.Values)
+		}
+		batchQuery[param] = batch
+		if err := h.get(path, batchQuery, &page); err != nil {
+			return found, err
+		}
+		for _, v := range page.Data {
+			key := keyOf(v)
+			if cache != nil {
+				cache.put(key, v)
+			}
+			found[key] = v
+		}
+	}
+	return found, nil
+}
+
+// Users looks up Twitch users by login, returning them indexed by lowercase
+// login.
+func (h *helixClient) Users(logins []string) (map[string]twitchUser, error) {
+	keys := make([]string, len(logins))
+	for i, login := range logins {
+		keys[i] = strings.ToLower(login)
+	}
+	users, err := lookup(h, h.userLogins, "/users", nil, "login", keys, func(u twitchUser) string { return u.Login })
+	for _, user := range users {
+		h.userIDs.put(user.ID, user)
+	}
+	if err != nil {
+		return users, fmt.Errorf("looking up Twitch users: %w", err)
+	}
+	return users, nil
+}
+
+// UsersByID looks up Twitch users by ID, returning them indexed by ID.
+func (h *helixClient) UsersByID(ids []string) (map[string]twitchUser, error) {
+	users, err := lookup(h, h.userIDs, "/users", nil, "id", ids, func(u twitchUser) string { return u.ID })
+	for _, user := range users {
+		h.userLogins.put(user.Login, user)
+	}
+	if err != nil {
+		return users, fmt.Errorf("looking up Twitch users: %w", err)
+	}
+	return users, nil
+}
+
+// User looks up a Twitch user by login.
+func (h *helixClient) User(login string) (twitchUser, error) {
+	users, err := h.Users([]string{login})
+	if err != nil {
+		return twitchUser{}, err
+	}
+	user, ok := users[strings.ToLower(login)]
+	if !ok {
+		return twitchUser{}, fmt.Errorf("Twitch user %v: %w", login, ErrNotFound)
+	}
+	return user, nil
+}
+
+// UserByID looks up a Twitch user by ID, which unlike the login does not
+// change when the user renames themselves.
+func (h *helixClient) UserByID(id string) (twitchUser, error) {
+	users, err := h.UsersByID([]string{id})
+	if err != nil {
+		return twitchUser{}, err
+	}
+	user, ok := users[id]
+	if !ok {
+		return twitchUser{}, fmt.Errorf("Twitch user %v: %w", id, ErrNotFound)
+	}
+	return user, nil
+}
+
+// Channel looks up a broadcaster's channel information: their title and
+// category.
+func (h *helixClient) Channel(broadcasterID string) (twitchChannel, error) {
+	channels, err := lookup(h, h.channels, "/channels", nil, "broadcaster_id", []string{broadcasterID}, func(c twitchChannel) string { return c.ID })
+	if err != nil {
+		return twitchChannel{}, fmt.Errorf("looking up Twitch channel %v: %w", broadcasterID, err)
+	}
+	channel, ok := channels[broadcasterID]
+	if !ok {
+		return twitchChannel{}, fmt.Errorf("Twitch channel %v: %w", broadcasterID, ErrNotFound)
+	}
+	return channel, nil
+}
+
+// forgetChannel drops the cached channel information for a broadcaster whose
+// title or category has changed.
+func (h *helixClient) forgetChannel(broadcasterID string) {
+	h.channels.forget(broadcasterID)
+}
+
+// Streams looks up the broadcasts of the given users that are live right
+// now, indexed by user ID. They are not cached, since viewer counts and
+// thumbnails are what they are wanted for. /streams is paginated, 20 to a page
+// unless asked for more, so a whole batch is asked for at once.
+func (h *helixClient) Streams(userIDs []string) (map[string]twitchStream, error) {
+	query := url.Values{"first": {strconv.Itoa(helixBatchSize)}}
+	streams, err := lookup(h, nil, "/streams", query, "user_id", userIDs, func(s twitchStream) string { return s.UserID })
+	if err != nil {
+		return streams, fmt.Errorf("looking up live streams: %w", err)
+	}
+	return streams, nil
+}
+
+// Archives lists a broadcaster's most recent past broadcasts, newest first.
+// They are not cached, since the point is to find new ones.
+func (h *helixClient) Archives(userID string) ([]twitchVideo, error) {
+	var videos struct {
+		Data []twitchVideo `json:"data"`
+	}
+	query := url.Values{"user_id": {userID}, "type": {"archive"}, "first": {"20"}}
+	if err := h.get("/videos", query, &videos); err != nil {
+		return nil, fmt.Errorf("looking up videos for %v: %w", userID, err)
+	}
+	return videos.Data, nil
+}
+
+// Game looks up a category by ID.
+func (h *helixClient) Game(id string) (twitchGame, error) {
+	games, err := lookup(h, h.games, "/games", nil, "id", []string{id}, func(g twitchGame) string { return g.ID })
+	if err != nil {
+		return twitchGame{}, fmt.Errorf("looking up Twitch game %v: %w", id, err)
+	}
+	game, ok := games[id]
+	if !ok {
+		return twitchGame{}, fmt.Errorf("Twitch game %v: %w", id, ErrNotFound)
+	}
+	return game, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestStreamsWholeBatch checks that live streams past the first page Helix
+// returns by default are not taken for offline ones.
+func TestStreamsWholeBatch(t *testing.T) {
+	fake := newFakeServices(t)
+	a := startTestApp(t, fake, nil, nil)
+
+	var ids []string
+	for i := 1; i <= 30; i++ {
+		id := fmt.Sprint(i)
+		fake.addUser(id, "streamer"+id)
+		fake.goLive(id, i)
+		ids = append(ids, id)
+	}
+	streams, err := a.helix.Streams(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != len(ids) {
+		t.Fatalf("found %d live streams, want %d", len(streams), len(ids))
+	}
+	for _, id := range ids {
+		if streams[id].UserID != id {
+			t.Errorf("stream for %v = %+v", id, streams[id])
+		}
+	}
+}
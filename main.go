@@ -3,31 +3,33 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	"strings"
+	"syscall"
 	"time"
 
-	"golang.org/x/oauth2"
-
 	"github.com/bwmarrin/discordgo"
-	"golang.org/x/oauth2/clientcredentials"
-	"golang.org/x/oauth2/twitch"
 )
 
-var (
-	twitchToken  *oauth2.Token
-	oauth2Config *clientcredentials.Config
-	client       *http.Client
-	config       *cofiguration
-)
+const (
+	cfgFile string = "cfg.txt"
 
-const cfgFile string = "cfg.txt"
+	defaultConfigBackups int = 5
+	maxConfigBackups     int = 50
+)
 
 func main() {
+	rotateSecret := flag.Bool("rotate-secret", false, "generate a new EventSub webhook secret and recreate subscriptions")
+	addAPIKey := flag.String("add-api-key", "", "create a REST API key with the given name, print it and exit")
+	flag.Parse()
+
 	logFile, err := os.OpenFile("paintbot.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatalf("error opening file: %v", err)
@@ -36,69 +38,26 @@ func main() {
 
 	log.SetOutput(logFile)
 
-	loadConfig()
-	//bytes, err := json.Marshal(config)
-	//log.Println(string(bytes))
-	generateToken()
-	log.Println("Token Generated")
-	client = &http.Client{}
-
-	go startListen()
-
-	subs := getSubscriptions("webhook_callback_verification_failed")
-
-	for _, subToDelete := range subs.Data {
-		deleteSubscription(subToDelete.ID)
+	app, err := NewApp(cfgFile, nil)
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer app.Close()
 
-	enabledSubs := getSubscriptions("enabled")
-	for _, currStream := range config.Streams {
-		if currStream.Type == twitchType {
-			log.Println(currStream.StreamName)
-			if len(currStream.UserId) < 1 {
-				currStream.UserId = getTwitchUser(currStream.StreamName).ID
-			}
-			subEnabled := false
-			for _, sub := range enabledSubs.Data {
-				if sub.Condition["broadcaster_user_id"] == currStream.UserId {
-					subEnabled = true
-					break
-				}
-			}
-			if subEnabled {
-				continue
-			}
-			registerTwitchWebhook(client, currStream.UserId, "stream.online")
-			registerTwitchWebhook(client, currStream.UserId, "stream.offline")
-			registerTwitchWebhook(client, currStream.UserId, "channel.update")
-		} else if currStream.Type == youtubeType {
-			setupYouTubeNotification(currStream)
-		}
+	if *addAPIKey != "" {
+		key, err := app.addAPIKey(*addAPIKey)
+		errCheck("Error creating API key", err)
+		fmt.Println(key)
+		return
 	}
 
-	discord := createDiscordSession()
-	errCheck("error retrieving account", err)
-
-	discord.AddHandler(func(discord *discordgo.Session, ready *discordgo.Ready) {
-		servers := discord.State.Guilds
-		log.Printf("PaintBot has started on %d servers\n", len(servers))
-	})
-
-	log.Println(getSubscriptions("enabled"))
+	err = app.Start(*rotateSecret)
+	errCheck("Error starting PaintBot", err)
 
-	err = discord.Open()
-	errCheck("Error opening connection to Discord", err)
-	defer discord.Close()
-
-	<-make(chan struct{})
-}
-
-func createDiscordSession() *discordgo.Session {
-	log.Println("Starting bot...")
-	discord, err := discordgo.New("Bot " + config.Secrets.BotToken)
-	errCheck("error creating discord session", err)
-	log.Println("New session created...")
-	return discord
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	log.Println("Shutting down")
 }
 
 func errCheck(msg string, err error) {
@@ -108,112 +67,255 @@ func errCheck(msg string, err error) {
 	}
 }
 
-func loadConfig() {
-	content, err := ioutil.ReadFile(cfgFile)
+func (a *App) loadConfig() error {
+	content, err := ioutil.ReadFile(a.cfgPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	json.Unmarshal(content, &config)
+	if err = validateConfig(content); err != nil {
+		backup := newestGoodBackup(a.cfgPath, maxConfigBackups)
+		if backup == "" {
+			return fmt.Errorf("%v is corrupt (%v) and no good backup was found", a.cfgPath, err)
+		}
+		return fmt.Errorf("%v is corrupt (%v), the newest good backup is %v: copy it over %v to start from it", a.cfgPath, err, backup, a.cfgPath)
+	}
+	json.Unmarshal(content, &a.config)
+	a.configFile, _ = os.Stat(a.cfgPath)
+
+	if a.config.ConfigBackups <= 0 {
+		a.config.ConfigBackups = defaultConfigBackups
+	}
+	if a.config.ConfigBackups > maxConfigBackups {
+		a.config.ConfigBackups = maxConfigBackups
+	}
+	if a.config.MessageRetention <= 0 {
+		a.config.MessageRetention = defaultMessageRetention
+	}
+	// IDs have to be remembered for as long as a signed delivery is accepted,
+	// or a replay of one that has been forgotten would be handled again.
+	if minRetention := int64(eventSubMaxMessageAge / time.Second); a.config.MessageRetention < minRetention {
+		a.config.MessageRetention = minRetention
+	}
+	if a.config.CostReserve < 0 {
+		a.config.CostReserve = 0
+	} else if a.config.CostReserve == 0 {
+		a.config.CostReserve = defaultCostReserve
+	}
+	if a.config.VODLookupWindow == 0 {
+		a.config.VODLookupWindow = defaultVODLookupWindow
+	}
+	if a.config.SubscriptionSync <= 0 {
+		a.config.SubscriptionSync = defaultSubscriptionSync
+	}
+	switch a.config.EventSubTransport {
+	case "":
+		a.config.EventSubTransport = webhookTransport
+	case webhookTransport, websocketTransport:
+	default:
+		return fmt.Errorf("unknown eventsub_transport %q, use %q or %q", a.config.EventSubTransport, webhookTransport, websocketTransport)
+	}
+	a.setDefaultEndpoints()
+	return nil
+}
 
-	for _, channel := range config.Streams {
+func (a *App) loadStreams() error {
+	streams, err := a.store.LoadStreams()
+	if err != nil {
+		return err
+	}
+
+	for _, channel := range streams {
 		if channel.Type == twitchType {
 			colour, err := strconv.ParseInt(channel.ColourString, 0, 64)
 			if err != nil {
-				log.Fatal(err)
-				return
+				return fmt.Errorf("bad colour for %v: %w", channel.StreamName, err)
 			}
 			channel.HighlightColour = colour
 		}
-	}
-}
-
-func generateToken() {
-	oauth2Config = &clientcredentials.Config{
-		ClientID:     config.Secrets.TwitchClientID,
-		ClientSecret: config.Secrets.TwitchClientSecret,
-		TokenURL:     twitch.Endpoint.TokenURL,
+		if channel.Template != nil {
+			if err := channel.Template.validate(); err != nil {
+				return fmt.Errorf("bad template for %v: %w", channel.StreamName, err)
+			}
+		}
+		for _, target := range channel.Channels {
+			if target.Template != nil {
+				if err := target.Template.validate(); err != nil {
+					return fmt.Errorf("bad template for %v in <#%v>: %w", channel.StreamName, target.ChannelID, err)
+				}
+			}
+		}
 	}
 
-	token, err := oauth2Config.Token(context.Background())
-	if err != nil {
-		log.Fatal(err)
+	a.streamsMu.Lock()
+	for _, stream := range streams {
+		stream.lookupName, stream.lookupID = stream.StreamName, stream.UserId
 	}
-	twitchToken = token
+	a.config.Streams = streams
+	a.streamsMu.Unlock()
+	return nil
 }
 
-func validateToken() {
-	req, _ := http.NewRequest("GET", "https://id.twitch.tv/oauth2/validate", nil)
-	req.Header.Add("Client-ID", config.Secrets.TwitchClientID)
-	req.Header.Add("Authorization", "Bearer "+twitchToken.AccessToken)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
-		log.Println("Token validated")
-		return
+// saveStream stores the stream, logging failures. The stream must be locked.
+func (a *App) saveStream(channel *streamInfo) {
+	a.indexStream(channel)
+	if err := a.store.SaveStream(channel); err != nil {
+		log.Printf("Could not save %v: %v\n", channel.StreamName, err)
 	}
-	generateToken()
 }
 
-func handleRoot(w http.ResponseWriter, r *http.Request) (err error) {
+func (a *App) handleRoot(w http.ResponseWriter, r *http.Request) (err error) {
 	w.Write([]byte("Hey bishes"))
 	return
 }
-func handleTwitchNotification(w http.ResponseWriter, r *http.Request) (err error) {
+func (a *App) handleTwitchNotification(w http.ResponseWriter, r *http.Request) (err error) {
 	log.Printf("Handling notification: %v\n", r.Method)
 	if r.Method != "POST" {
 		log.Printf("Notification was not a POST: %v\n", r.Method)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if r.Header.Get("Twitch-Eventsub-Message-Type") == "webhook_callback_verification" {
-		body, _ := ioutil.ReadAll(r.Body)
-		// if err != nil {
-		//      panic(err)
-		// }
-		var callbackVerification callbackVerification
-		_ = json.Unmarshal(body, &callbackVerification)
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
 
-		// if err != nil {
-		//      panic(err)
-		// }
+	secret, previousSecret := a.eventSubSecrets()
+	err = verifyEventSubMessage(r.Header, body, time.Now(), secret, previousSecret)
+	if err != nil {
+		log.Printf("Rejected notification %v: %v\n", r.Header.Get(eventSubMessageIDHeader), err)
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+
+	if r.Header.Get(eventSubMessageTypeHeader) == "webhook_callback_verification" {
+		var callbackVerification callbackVerification
+		err = json.Unmarshal(body, &callbackVerification)
+		if err != nil {
+			return err
+		}
 		w.Write([]byte(callbackVerification.Challenge))
 		return
 	}
 
+	// Twitch only waits a few seconds for an answer, so it is sent before the
+	// message is looked at.
 	w.WriteHeader(http.StatusNoContent)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
 	log.Printf("Responded to webhook\n")
-	defer r.Body.Close()
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Println(err)
+
+	a.handleEventSubMessage(r.Header.Get(eventSubMessageIDHeader), r.Header.Get(eventSubMessageTypeHeader), body)
+	return
+}
+
+// handleEventSubMessage handles a notification or revocation, whichever
+// transport it arrived over. Messages Twitch delivers more than once are only
+// handled the first time; one that could not be queued is handled again if it
+// is redelivered.
+func (a *App) handleEventSubMessage(messageID string, messageType string, body []byte) {
+	if !a.seenMessages.claim(messageID) {
+		log.Printf("Notification %v has already been handled, ignoring\n", messageID)
+		return
 	}
 
-	var twitchNotif notification
-	err = json.Unmarshal(body, &twitchNotif)
+	var queued bool
+	defer func() {
+		a.seenMessages.finish(messageID, queued, time.Now())
+	}()
 
+	var twitchNotif notification
+	err := json.Unmarshal(body, &twitchNotif)
 	if err != nil {
 		log.Println(err)
+		return
+	}
+
+	switch messageType {
+	case "notification":
+		queued = a.queueTwitchEvent(twitchNotif)
+	case "revocation":
+		queued = a.queueTwitchRevocation(twitchNotif.SubscriptionInfo)
+	default:
+		log.Printf("Ignoring unknown message type %v\n", messageType)
+		queued = true
+	}
+}
+
+// queueTwitchEvent hands a notification to its stream's event queue, so that
+// events for one broadcaster are applied in the order they arrived. It
+// reports false if the notification was for a stream but could not be
+// queued.
+func (a *App) queueTwitchEvent(twitchNotif notification) bool {
+	userID, _ := twitchNotif.Event["broadcaster_user_id"].(string)
+	userName, _ := twitchNotif.Event["broadcaster_user_name"].(string)
+	log.Println("Webhook notification for: ", userName, twitchNotif.SubscriptionInfo.Type)
+
+	channel := a.findChannel(userID, twitchType)
+	if channel == nil {
+		channel = a.findChannel(userName, twitchType)
+	}
+	if channel == nil {
+		log.Printf("No stream configured for %v (%v), ignoring notification\n", userName, userID)
+		return true
+	}
+
+	if !channel.dispatch(func() {
+		a.handleTwitchEvent(channel, twitchNotif)
+	}) {
+		log.Printf("Dropped %v notification for %v: its event queue is full or it was removed\n", twitchNotif.SubscriptionInfo.Type, userName)
+		return false
+	}
+	return true
+}
+
+// handleTwitchEvent applies a notification to channel. It runs on the stream's
+// event queue with the stream locked.
+func (a *App) handleTwitchEvent(channel *streamInfo, twitchNotif notification) {
+	login, _ := twitchNotif.Event["broadcaster_user_login"].(string)
+	displayName, _ := twitchNotif.Event["broadcaster_user_name"].(string)
+	if channel.setTwitchNames(login, displayName) {
+		a.saveStream(channel)
 	}
-	log.Println("Webhook notification for: ", twitchNotif.Event["broadcaster_user_name"], twitchNotif.SubscriptionInfo.Type)
-	channel := findChannel(twitchNotif.Event["broadcaster_user_name"].(string), twitchType)
 
 	if twitchNotif.SubscriptionInfo.Type == "stream.online" {
+		broadcastType, _ := twitchNotif.Event["type"].(string)
+		if !channel.announces(broadcastType) {
+			// Treated as if the stream never went live, so its offline
+			// event leaves the last announcement alone too.
+			log.Printf("Not announcing %v's %v broadcast\n", channel.StreamName, broadcastType)
+			return
+		}
+		channel.BroadcastType = broadcastType
 		if len(channel.Title) == 0 {
-			twitchChannel := getTwitchChannel(channel.UserId)
+			twitchChannel, err := a.helix.Channel(channel.UserId)
+			if err != nil {
+				log.Printf("Announcing %v without a title: %v\n", channel.StreamName, err)
+			}
 			channel.Title = twitchChannel.Title
 			channel.Category = twitchChannel.GameID
 		}
-		onlineDate, _ := time.Parse(time.RFC3339, twitchNotif.Event["started_at"].(string))
+		channel.CurrentStreamID, _ = twitchNotif.Event["id"].(string)
+		startedAt, _ := twitchNotif.Event["started_at"].(string)
+		onlineDate, _ := time.Parse(time.RFC3339, startedAt)
 
 		if channel.DisableOffline || onlineDate.Unix()-channel.LastOffline > channel.OfflineTime {
-			postNotification(channel)
+			channel.StartedAt = onlineDate.Unix()
+			channel.startTimeline(channel.CurrentStreamID, onlineDate)
+		} else {
+			// Back within the offline timeout: the announcement, already
+			// marked as ended, is edited back to live instead, and the
+			// broadcast's timeline carries on.
+			channel.IsLive = true
+			if channel.Timeline != nil {
+				channel.Timeline.EndedAt = 0
+			}
 		}
+		a.postNotification(channel)
 		channel.IsLive = true
+		a.saveStream(channel)
 	} else if twitchNotif.SubscriptionInfo.Type == "stream.offline" {
 		if !channel.IsLive {
 			log.Println("Channel is already offline, ignoring notification")
@@ -221,20 +323,37 @@ func handleTwitchNotification(w http.ResponseWriter, r *http.Request) (err error
 		}
 		channel.IsLive = false
 		channel.LastOffline = time.Now().Unix()
-		writeConfig()
+		channel.viewers = 0
+		channel.nextRefresh = time.Time{}
+		if channel.Timeline != nil {
+			channel.Timeline.EndedAt = channel.LastOffline
+		}
+		a.saveStream(channel)
+		a.endNotification(channel, "")
+		if channel.Timeline != nil {
+			a.postSummary(channel)
+		}
+		if channel.CurrentStreamID != "" && a.config.VODLookupWindow > 0 {
+			go a.findVOD(channel, channel.CurrentStreamID)
+		}
 	} else if twitchNotif.SubscriptionInfo.Type == "channel.update" {
-		channel.Title = twitchNotif.Event["title"].(string)
-		channel.Category = twitchNotif.Event["category_id"].(string)
+		channel.Title, _ = twitchNotif.Event["title"].(string)
+		channel.Category, _ = twitchNotif.Event["category_id"].(string)
+		if channel.IsLive && channel.Timeline != nil {
+			channel.Timeline.record(channel.Title, channel.Category, time.Now())
+		}
+		a.saveStream(channel)
+		a.helix.forgetChannel(channel.UserId)
 
 		if channel.IsLive {
-			go postNotification(channel)
+			a.postNotification(channel)
 		}
 	}
-
-	return
 }
 
-func startListen() {
+// Handler returns the bot's HTTP routes: the root page, the Twitch and YouTube
+// webhook callbacks and the dashboard.
+func (a *App) Handler() http.Handler {
 	var middleware = func(h Handler) Handler {
 		return func(w http.ResponseWriter, r *http.Request) (err error) {
 			// parse POST body, limit request size
@@ -261,107 +380,141 @@ func startListen() {
 		})
 	}
 
+	mux := http.NewServeMux()
 	var handleFunc = func(path string, handler Handler) {
-		http.Handle(path, errorHandling(middleware(handler)))
+		mux.Handle(path, errorHandling(middleware(handler)))
 	}
-	handleFunc("/", handleRoot)
-	handleFunc("/notify", handleTwitchNotification)
-	handleFunc("/youtube", handleYoutubeNotification)
+	handleFunc("/", a.handleRoot)
+	handleFunc("/notify", a.handleTwitchNotification)
+	handleFunc("/youtube", a.handleYoutubeNotification)
+	a.dashboardRoutes(handleFunc)
+	a.apiRoutes(handleFunc)
 
-	go log.Fatal(http.ListenAndServe(":8080", nil))
+	return mux
 }
 
-func postNotification(channel *streamInfo) {
-	log.Println("Posting notification")
-	user := getTwitchUser(channel.StreamName)
+func (a *App) startListen() error {
+	listener, err := net.Listen("tcp", a.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	a.listener = listener
+	a.server = &http.Server{Handler: a.Handler()}
 
-	var game *twitchGame
-	if len(channel.Category) > 0 {
-		game = getTwitchGame(channel.Category)
+	go func() {
+		if err := a.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return nil
+}
+
+// twitchDetails looks up the broadcaster and category for an announcement.
+// The user is looked up by ID, which survives renames; if Twitch cannot be
+// reached or no longer has the user, the profile picture from last time is
+// used. A category that cannot be found is shown as N/A.
+func (a *App) twitchDetails(channel *streamInfo) (twitchUser, twitchGame) {
+	user, err := a.helix.UserByID(channel.UserId)
+	if err != nil {
+		log.Printf("Using cached details for %v: %v\n", channel.StreamName, err)
+		user.ProfileImage = channel.ProfileImage
+	} else if renamed := channel.setTwitchNames(user.Login, user.DisplayName); renamed || user.ProfileImage != channel.ProfileImage {
+		channel.ProfileImage = user.ProfileImage
+		a.saveStream(channel)
 	}
-	if game == nil {
-		game = &twitchGame{
-			Name:   "N/A",
-			BoxArt: "https://images.igdb.com/igdb/image/upload/t_cover_big/nocover_qhhlj6.png",
+
+	if len(channel.Category) > 0 {
+		game, err := a.helix.Game(channel.Category)
+		if err == nil {
+			return user, game
 		}
+		log.Printf("Announcing %v without a game: %v\n", channel.StreamName, err)
 	}
-	embed := &discordgo.MessageEmbed{
-		Author: &discordgo.MessageEmbedAuthor{
-			URL:     "https://www.twitch.tv/" + channel.StreamName,
-			Name:    channel.StreamName,
-			IconURL: strings.Replace(strings.Replace(user.ProfileImage, "{width}", "70", 1), "{height}", "70", 1),
-		},
-		Color: int(channel.HighlightColour),
-		Fields: []*discordgo.MessageEmbedField{
-			{
-				Name:   "Game",
-				Value:  game.Name,
-				Inline: true,
-			},
-		},
-		Image: &discordgo.MessageEmbedImage{
-			URL: "https://static-cdn.jtvnw.net/previews-ttv/live_user_" + channel.StreamName + "-320x180.png" + "?r=" + time.Now().Format(time.RFC3339),
-		},
-		Thumbnail: &discordgo.MessageEmbedThumbnail{
-			URL: strings.Replace(strings.Replace(game.BoxArt, "{width}", "500", 1), "{height}", "700", 1),
-		},
-		Title: channel.Title,
-		URL:   "https://www.twitch.tv/" + channel.StreamName,
-	}
-
-	discord := createDiscordSession()
-	defer discord.Close()
-	message := &discordgo.MessageSend{
-		Embeds: []*discordgo.MessageEmbed{embed},
-	}
-
-	if channel.Description != "" {
-		message.Content = channel.Description
+	return user, twitchGame{
+		Name:   "N/A",
+		BoxArt: "https://images.igdb.com/igdb/image/upload/t_cover_big/nocover_qhhlj6.png",
 	}
+}
+
+func (a *App) postNotification(channel *streamInfo) {
+	log.Println("Posting notification")
+	user, game := a.twitchDetails(channel)
+	data := announcementFor(channel, user, game)
 
 	var msg *discordgo.Message
 	var err error
 	for i, channelID := range channel.Channels {
-		if channel.IsLive {
+		if !channelID.Filter.allows(game, channel.Title) {
+			a.withdrawNotification(channel, i)
+			continue
+		}
+		message := a.announcement(channel, channelID, data)
+		if channel.IsLive && channelID.MessageID != "" {
 			messageEdit := &discordgo.MessageEdit{
 				ID:      channelID.MessageID,
 				Channel: channelID.ChannelID,
 				Content: &message.Content,
 				Embeds:  message.Embeds,
 			}
-			msg, err = discord.ChannelMessageEditComplex(messageEdit)
+			msg, err = a.discord.ChannelMessageEditComplex(messageEdit)
 		} else {
-			msg, err = discord.ChannelMessageSendComplex(channelID.ChannelID, message)
+			msg, err = a.discord.ChannelMessageSendComplex(channelID.ChannelID, message)
 		}
 
 		if err != nil {
 			log.Printf("%v did not send: %v\n", msg, err)
 		} else {
 			channel.Channels[i].MessageID = msg.ID
+			if err = a.store.SetMessageID(channel, channelID.ChannelID, msg.ID); err != nil {
+				log.Printf("Could not save message ID: %v\n", err)
+			}
 		}
 	}
-	writeConfig()
 }
 
-func writeConfig() {
-	f, err := os.OpenFile("cfg.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
-	if err != nil {
-		log.Fatal(err)
+// withdrawNotification deletes the announcement in the stream's i'th channel,
+// whose filter no longer allows the broadcast. The message of a broadcast
+// that has already ended is kept, only forgotten so it is not edited again.
+func (a *App) withdrawNotification(channel *streamInfo, i int) {
+	target := channel.Channels[i]
+	if target.MessageID == "" {
+		return
 	}
-	defer f.Close()
+	if channel.IsLive {
+		if err := a.discord.ChannelMessageDelete(target.ChannelID, target.MessageID); err != nil {
+			log.Printf("Could not remove the announcement of %v from <#%v>: %v\n", channel.StreamName, target.ChannelID, err)
+		}
+	}
+	channel.Channels[i].MessageID = ""
+	if err := a.store.SetMessageID(channel, target.ChannelID, ""); err != nil {
+		log.Printf("Could not save message ID: %v\n", err)
+	}
+}
 
-	bytes, err := json.Marshal(config)
+func (a *App) writeConfig() {
+	a.configMu.Lock()
+	defer a.configMu.Unlock()
+	a.writeConfigLocked()
+}
+
+// writeConfigLocked saves the config, first taking any API keys added to the
+// file meanwhile so they are not overwritten. configMu must be held.
+func (a *App) writeConfigLocked() {
+	a.reloadAPIKeys()
+	stored := *a.config
+	stored.Streams = nil
+	if js, ok := a.store.(*jsonStore); ok {
+		stored.Streams = js.snapshot()
+	}
+	bytes, err := json.Marshal(stored)
 	if err != nil {
 		log.Fatal(err)
 	}
-	f.Write(bytes)
-}
 
-func findChannel(name string, channelType int) (channel *streamInfo) {
-	for _, currChannel := range config.Streams {
-		if (strings.EqualFold(currChannel.StreamName, name) || strings.EqualFold(currChannel.UserId, name)) && currChannel.Type == channelType {
-			return currChannel
-		}
+	err = writeFileAtomic(a.cfgPath, bytes, 0600, a.config.ConfigBackups)
+	if err != nil {
+		log.Printf("Could not write %v, the previous version is unchanged: %v\n", a.cfgPath, err)
+		return
 	}
-	return nil
+	a.configFile, _ = os.Stat(a.cfgPath)
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestNotificationBurst delivers a burst of notifications for several streams
+// while one stream's event is stuck on a slow Helix request. Every delivery
+// must still be answered straight away, and every event applied once Helix
+// answers.
+func TestNotificationBurst(t *testing.T) {
+	const streamCount, updatesPerStream = 5, 10
+
+	fake := newFakeServices(t)
+	var streams []*streamInfo
+	for i := 1; i <= streamCount; i++ {
+		id, login := fmt.Sprint(i), fmt.Sprintf("streamer%d", i)
+		fake.addUser(id, login)
+		streams = append(streams, &streamInfo{
+			StreamName:   login,
+			UserId:       id,
+			ColourString: "0x9146FF",
+			Type:         twitchType,
+			Channels:     []discordChannel{{ChannelID: fmt.Sprint(200 + i)}},
+			OfflineTime:  600,
+		})
+	}
+	a := startTestApp(t, fake, streams, nil)
+
+	// The first stream's announcement waits on the broadcaster lookup until
+	// the burst has been delivered.
+	held := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	fake.setHelixHook(func(r *http.Request) {
+		if r.URL.Path == "/helix/users" && r.URL.Query().Get("id") == "1" {
+			once.Do(func() { close(held) })
+			<-release
+		}
+	})
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	online := twitchEvent("stream.online", "1", "streamer1", map[string]any{
+		"id":         "stream-1",
+		"type":       "live",
+		"started_at": time.Now().UTC().Format(time.RFC3339),
+	})
+	if status := sendEventSub(t, a, "online-1", "notification", online); status != http.StatusNoContent {
+		t.Fatalf("stream.online returned %v", status)
+	}
+	select {
+	case <-held:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the announcement never looked up the broadcaster")
+	}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= streamCount; i++ {
+		for n := 0; n < updatesPerStream; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				update := twitchEvent("channel.update", fmt.Sprint(i), fmt.Sprintf("streamer%d", i), map[string]any{
+					"title":       fmt.Sprintf("update %d", n),
+					"category_id": "509660",
+				})
+				messageID := fmt.Sprintf("update-%d-%d", i, n)
+				if status := sendEventSub(t, a, messageID, "notification", update); status != http.StatusNoContent {
+					t.Errorf("%v returned %v", messageID, status)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	// A redelivery is acknowledged but not applied again.
+	if status := sendEventSub(t, a, "update-1-0", "notification", twitchEvent("channel.update", "1", "streamer1", nil)); status != http.StatusNoContent {
+		t.Errorf("redelivery returned %v", status)
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+	close(release)
+
+	// Stream one is live by the time its updates run, so each of them edits
+	// the announcement.
+	eventually(t, "the announcement and its edits", func() bool {
+		var posts, edits int
+		for _, m := range fake.sentMessages() {
+			if m.ChannelID != "201" {
+				continue
+			}
+			switch m.Method {
+			case http.MethodPost:
+				posts++
+			case http.MethodPatch:
+				edits++
+			}
+		}
+		return posts == 1 && edits == updatesPerStream
+	})
+	for _, stream := range a.allStreams() {
+		eventually(t, stream.StreamName+"'s updates", func() bool {
+			var title string
+			stream.withStream(func() { title = stream.Title })
+			return strings.HasPrefix(title, "update ")
+		})
+	}
+	for _, m := range fake.sentMessages() {
+		if m.ChannelID != "201" {
+			t.Errorf("announced in %v, but only streamer1 went live", m.ChannelID)
+		}
+	}
+}
+
+// TestFullQueueDropsEvent checks that a notification for a stream whose event
+// queue is full is dropped rather than holding up the handler, and handled if
+// Twitch delivers it again.
+func TestFullQueueDropsEvent(t *testing.T) {
+	fake := newFakeServices(t)
+	fake.addUser("1", "streamer1")
+	a := startTestApp(t, fake, []*streamInfo{{
+		StreamName:   "streamer1",
+		UserId:       "1",
+		ColourString: "0x9146FF",
+		Type:         twitchType,
+		Channels:     []discordChannel{{ChannelID: "201"}},
+	}}, nil)
+
+	stream := a.findChannel("1", twitchType)
+	running, release := make(chan struct{}), make(chan struct{})
+	stream.dispatch(func() {
+		close(running)
+		<-release
+	})
+	<-running
+	for i := 0; i < streamEventQueueSize; i++ {
+		if !stream.dispatch(func() {}) {
+			t.Fatalf("event %v did not fit in the queue", i)
+		}
+	}
+
+	update := twitchEvent("channel.update", "1", "streamer1", map[string]any{"title": "dropped", "category_id": "509660"})
+	body, _ := json.Marshal(update)
+	handled := make(chan struct{})
+	go func() {
+		a.handleEventSubMessage("update-1", "notification", body)
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("the handler waited for the full queue")
+	}
+
+	// Twitch keeps redelivering until the queue has room again.
+	close(release)
+	eventually(t, "the redelivered update", func() bool {
+		a.handleEventSubMessage("update-1", "notification", body)
+		var title string
+		stream.withStream(func() { title = stream.Title })
+		return title == "dropped"
+	})
+}
+
+// TestBroadcastTypes checks that only the kinds of broadcast a stream asks for
+// are announced, each worded for its kind.
+func TestBroadcastTypes(t *testing.T) {
+	fake := newFakeServices(t)
+	fake.addUser("1", "streamer1")
+	a := startTestApp(t, fake, []*streamInfo{{
+		StreamName:    "streamer1",
+		UserId:        "1",
+		ColourString:  "0x9146FF",
+		Type:          twitchType,
+		Channels:      []discordChannel{{ChannelID: "201"}},
+		AnnounceTypes: []string{"live", "premiere"},
+	}}, nil)
+	stream := a.findChannel("1", twitchType)
+	online := func(messageID string, broadcastType string) {
+		t.Helper()
+		event := twitchEvent("stream.online", "1", "streamer1", map[string]any{
+			"id":         messageID,
+			"type":       broadcastType,
+			"started_at": time.Now().UTC().Format(time.RFC3339),
+		})
+		if status := sendEventSub(t, a, messageID, "notification", event); status != http.StatusNoContent {
+			t.Fatalf("stream.online returned %v", status)
+		}
+	}
+
+	online("rerun-1", "rerun")
+	eventually(t, "the rerun to be queued", func() bool {
+		a.seenMessages.mu.Lock()
+		defer a.seenMessages.mu.Unlock()
+		_, queued := a.seenMessages.seen["rerun-1"]
+		return queued
+	})
+	drained := make(chan struct{})
+	stream.dispatch(func() { close(drained) })
+	<-drained
+	if messages := fake.sentMessages(); len(messages) != 0 {
+		t.Fatalf("a rerun was announced: %+v", messages[0])
+	}
+
+	online("premiere-1", "premiere")
+	eventually(t, "the premiere announcement", func() bool { return len(fake.sentMessages()) == 1 })
+	announced := fake.sentMessages()[0]
+	if len(announced.Embeds) == 0 || announced.Embeds[0].Description != "STREAMER1 is premiering a video." {
+		t.Errorf("premiere announced as %+v", announced.Embeds)
+	}
+
+	if status := sendEventSub(t, a, "offline-1", "notification", twitchEvent("stream.offline", "1", "streamer1", nil)); status != http.StatusNoContent {
+		t.Fatalf("stream.offline returned %v", status)
+	}
+	eventually(t, "the ended announcement", func() bool {
+		for _, m := range fake.sentMessages() {
+			if m.Method == http.MethodPatch && len(m.Embeds) > 0 && m.Embeds[0].Description == "STREAMER1 premiered a video." {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// TestEndedKeepsTemplate checks that the announcement edited at the end of a
+// stream is built from the same templates as the one that announced it.
+func TestEndedKeepsTemplate(t *testing.T) {
+	fake := newFakeServices(t)
+	fake.addUser("1", "streamer1")
+	a := startTestApp(t, fake, []*streamInfo{{
+		StreamName:   "streamer1",
+		UserId:       "1",
+		ColourString: "0x9146FF",
+		Type:         twitchType,
+		Channels: []discordChannel{{
+			ChannelID: "201",
+			Template:  &announcementTemplate{Content: "{{.Name}} {{if .Ended}}was{{else}}is{{end}} on"},
+		}},
+		Template: &announcementTemplate{
+			Colour:      "0x123456",
+			Description: "{{if .Ended}}Thanks for watching{{else}}Come and watch{{end}}",
+		},
+	}}, nil)
+
+	online := twitchEvent("stream.online", "1", "streamer1", map[string]any{
+		"id":         "stream-1",
+		"type":       "live",
+		"started_at": time.Now().UTC().Format(time.RFC3339),
+	})
+	if status := sendEventSub(t, a, "online-1", "notification", online); status != http.StatusNoContent {
+		t.Fatalf("stream.online returned %v", status)
+	}
+	eventually(t, "the announcement", func() bool { return len(fake.sentMessages()) == 1 })
+	if status := sendEventSub(t, a, "offline-1", "notification", twitchEvent("stream.offline", "1", "streamer1", nil)); status != http.StatusNoContent {
+		t.Fatalf("stream.offline returned %v", status)
+	}
+
+	var ended fakeMessage
+	eventually(t, "the ended announcement", func() bool {
+		for _, m := range fake.sentMessages() {
+			if m.Method == http.MethodPatch {
+				ended = m
+				return true
+			}
+		}
+		return false
+	})
+	if ended.Content != "STREAMER1 was on" {
+		t.Errorf("content = %q", ended.Content)
+	}
+	if len(ended.Embeds) != 1 {
+		t.Fatalf("embeds = %+v", ended.Embeds)
+	}
+	if embed := ended.Embeds[0]; embed.Color != 0x123456 || embed.Description != "Thanks for watching" {
+		t.Errorf("ended embed has colour %#x and description %q", embed.Color, embed.Description)
+	}
+}
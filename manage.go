@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// defaultTwitchColour is the embed colour for streams added without one.
+const defaultTwitchColour string = "0x9146FF"
+
+var (
+	errStreamNotFound     = errors.New("stream is not being announced")
+	errTargetExists       = errors.New("stream is already announced in that channel")
+	errTargetNotFound     = errors.New("stream is not announced in that channel")
+	errTwitchUserNotFound = errors.New("no Twitch user with that login")
+
+	youtubeChannelID = regexp.MustCompile(`^UC[0-9A-Za-z_-]{22}$`)
+	discordSnowflake = regexp.MustCompile(`^[0-9]{17,20}$`)
+)
+
+// inputError is a value given by a user that the bot refuses, as opposed to
+// a failure acting on it.
+type inputError string
+
+func (e inputError) Error() string {
+	return string(e)
+}
+
+// streamSettings are the parts of a stream that can be changed once it is
+// being announced.
+type streamSettings struct {
+	Colour          string
+	Description     string
+	OfflineTime     int64
+	DisableOffline  bool
+	RefreshInterval int64
+	PostSummary     bool
+	AnnounceTypes   []string
+}
+
+// addTwitchStream starts announcing a Twitch streamer in a Discord channel. A
+// streamer that is already tracked gets the channel added to its targets;
+// otherwise a new stream is created and subscribed to.
+func (a *App) addTwitchStream(login string, channelID string) (*streamInfo, error) {
+	login = strings.ToLower(strings.TrimSpace(login))
+	if err := validateChannelID(channelID); err != nil {
+		return nil, err
+	}
+	if existing := a.findChannel(login, twitchType); existing != nil {
+		return existing, a.addTarget(existing, channelID)
+	}
+
+	user, err := a.helix.User(login)
+	if errors.Is(err, ErrNotFound) {
+		return nil, errTwitchUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if existing := a.findChannel(user.ID, twitchType); existing != nil {
+		return existing, a.addTarget(existing, channelID)
+	}
+
+	colour, _ := strconv.ParseInt(defaultTwitchColour, 0, 64)
+	stream := &streamInfo{
+		StreamName:      user.Login,
+		DisplayName:     user.DisplayName,
+		UserId:          user.ID,
+		Type:            twitchType,
+		Channels:        []discordChannel{{ChannelID: channelID}},
+		ColourString:    defaultTwitchColour,
+		HighlightColour: colour,
+	}
+	if err = a.addStream(stream); err != nil {
+		return nil, err
+	}
+
+	stream.withStream(func() {
+		if err = a.subscribeTwitchStream(stream); err != nil {
+			stream.Unsubscribed = true
+		}
+		a.saveStream(stream)
+	})
+	if err != nil {
+		return stream, fmt.Errorf("added %v but could not subscribe to its events: %w", stream.StreamName, err)
+	}
+	return stream, nil
+}
+
+// addYoutubeStream starts announcing uploads from a YouTube channel in a
+// Discord channel.
+func (a *App) addYoutubeStream(youtubeID string, name string, channelID string) (*streamInfo, error) {
+	youtubeID = strings.TrimSpace(youtubeID)
+	if !youtubeChannelID.MatchString(youtubeID) {
+		return nil, inputError(fmt.Sprintf("%q is not a YouTube channel ID", youtubeID))
+	}
+	if err := validateChannelID(channelID); err != nil {
+		return nil, err
+	}
+	if existing := a.findChannel(youtubeID, youtubeType); existing != nil {
+		return existing, a.addTarget(existing, channelID)
+	}
+
+	if name == "" {
+		name = youtubeID
+	}
+	stream := &streamInfo{
+		StreamName: name,
+		UserId:     youtubeID,
+		Type:       youtubeType,
+		Channels:   []discordChannel{{ChannelID: channelID}},
+	}
+	if err := a.addStream(stream); err != nil {
+		return nil, err
+	}
+	stream.withStream(func() {
+		a.setupYouTubeNotification(stream)
+	})
+	return stream, nil
+}
+
+// updateStream changes the settings of a tracked stream and saves it. An
+// empty colour keeps the current one.
+func (a *App) updateStream(stream *streamInfo, settings streamSettings) error {
+	var colour int64
+	if settings.Colour != "" {
+		var err error
+		if colour, err = parseColour(settings.Colour); err != nil {
+			return err
+		}
+	}
+	if settings.OfflineTime < 0 {
+		return inputError("offline time cannot be negative")
+	}
+	if err := validateRefreshInterval(settings.RefreshInterval); err != nil {
+		return err
+	}
+	if err := validateAnnounceTypes(settings.AnnounceTypes); err != nil {
+		return err
+	}
+
+	var err error
+	stream.withStream(func() {
+		if settings.Colour != "" {
+			stream.ColourString = settings.Colour
+			stream.HighlightColour = colour
+		}
+		stream.Description = settings.Description
+		stream.OfflineTime = settings.OfflineTime
+		stream.DisableOffline = settings.DisableOffline
+		stream.RefreshInterval = settings.RefreshInterval
+		stream.PostSummary = settings.PostSummary
+		stream.AnnounceTypes = settings.AnnounceTypes
+		err = a.store.SaveStream(stream)
+	})
+	return err
+}
+
+// validateRefreshInterval checks a live refresh interval: off, or no more
+// often than minLiveRefresh.
+func validateRefreshInterval(seconds int64) error {
+	if seconds != 0 && seconds < minLiveRefresh {
+		return inputError(fmt.Sprintf("refresh interval must be 0 to turn it off, or at least %v seconds", minLiveRefresh))
+	}
+	return nil
+}
+
+// parseColour parses an embed colour such as 0x9146FF.
+func parseColour(s string) (int64, error) {
+	colour, err := strconv.ParseInt(s, 0, 64)
+	if err != nil || colour < 0 || colour > 0xFFFFFF {
+		return 0, inputError(fmt.Sprintf("%q is not a colour, use a hex value like 0x9146FF", s))
+	}
+	return colour, nil
+}
+
+func validateChannelID(channelID string) error {
+	if !discordSnowflake.MatchString(channelID) {
+		return inputError(fmt.Sprintf("%q is not a Discord channel ID", channelID))
+	}
+	return nil
+}
+
+func (a *App) addTarget(stream *streamInfo, channelID string) error {
+	var err error
+	stream.withStream(func() {
+		for _, target := range stream.Channels {
+			if target.ChannelID == channelID {
+				err = errTargetExists
+				return
+			}
+		}
+		stream.Channels = append(stream.Channels, discordChannel{ChannelID: channelID})
+		err = a.store.SaveStream(stream)
+	})
+	return err
+}
+
+// setTargetFilter changes the filter of one of a stream's Discord channels.
+// A nil filter announces everything there.
+func (a *App) setTargetFilter(stream *streamInfo, channelID string, filter *channelFilter) error {
+	if filter != nil {
+		if err := filter.validate(); err != nil {
+			return err
+		}
+	}
+	err := errTargetNotFound
+	stream.withStream(func() {
+		for i, target := range stream.Channels {
+			if target.ChannelID == channelID {
+				stream.Channels[i].Filter = filter
+				err = a.store.SaveStream(stream)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// setStreamTemplate changes the template of a stream's announcements, or of
+// its announcements in one Discord channel when channelID is set. A nil or
+// empty template goes back to the default layout.
+func (a *App) setStreamTemplate(stream *streamInfo, channelID string, t *announcementTemplate) error {
+	t, err := normaliseTemplate(t)
+	if err != nil {
+		return err
+	}
+	stream.withStream(func() {
+		if channelID == "" {
+			stream.Template = t
+			err = a.store.SaveStream(stream)
+			return
+		}
+		err = errTargetNotFound
+		for i, target := range stream.Channels {
+			if target.ChannelID == channelID {
+				stream.Channels[i].Template = t
+				err = a.store.SaveStream(stream)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// removeTarget stops announcing a stream in the channels of one Discord guild,
+// or only in channelID when it is given, deleting the stream once no guild has
+// channels left for it.
+func (a *App) removeTarget(streamType int, name string, guildID string, channelID string) (*streamInfo, error) {
+	stream := a.findChannel(strings.TrimSpace(name), streamType)
+	if stream == nil {
+		return nil, errStreamNotFound
+	}
+
+	var remove []string
+	for _, target := range a.guildTargets(stream, guildID) {
+		if channelID == "" || target == channelID {
+			remove = append(remove, target)
+		}
+	}
+	if len(remove) == 0 && channelID != "" {
+		return stream, errTargetNotFound
+	}
+	if len(remove) == 0 {
+		return stream, errStreamNotFound
+	}
+	return stream, a.removeStreamTarget(stream, remove...)
+}
+
+// removeStreamTarget stops announcing stream in the given Discord channels,
+// deleting the stream once it has no channels left.
+func (a *App) removeStreamTarget(stream *streamInfo, channelIDs ...string) error {
+	var remaining int
+	var err error
+	stream.withStream(func() {
+		targets := stream.Channels[:0:0]
+		for _, target := range stream.Channels {
+			if !slices.Contains(channelIDs, target.ChannelID) {
+				targets = append(targets, target)
+			}
+		}
+		if len(targets) == len(stream.Channels) {
+			err = errTargetNotFound
+			return
+		}
+		stream.Channels = targets
+		remaining = len(targets)
+		if remaining > 0 {
+			err = a.store.SaveStream(stream)
+		}
+	})
+	if err != nil || remaining > 0 {
+		return err
+	}
+	return a.deleteStream(stream)
+}
+
+// guildTargets returns the channels stream is announced in that belong to one
+// of the given Discord guilds.
+func (a *App) guildTargets(stream *streamInfo, guildIDs ...string) []string {
+	var targets []string
+	stream.withStream(func() {
+		for _, target := range stream.Channels {
+			targets = append(targets, target.ChannelID)
+		}
+	})
+	return slices.DeleteFunc(targets, func(channelID string) bool {
+		guild, err := a.channelGuild(channelID)
+		if err != nil {
+			log.Printf("Could not find the server of <#%v>: %v\n", channelID, err)
+		}
+		return !slices.Contains(guildIDs, guild)
+	})
+}
+
+// channelGuild returns the ID of the Discord guild a channel belongs to,
+// asking Discord when the gateway has not told us about the channel.
+func (a *App) channelGuild(channelID string) (string, error) {
+	if channel, err := a.discord.State.Channel(channelID); err == nil {
+		return channel.GuildID, nil
+	}
+	channel, err := a.discord.Channel(channelID)
+	if err != nil {
+		return "", err
+	}
+	return channel.GuildID, nil
+}
+
+// deleteStream stops tracking a stream and drops its Twitch or YouTube
+// subscriptions.
+func (a *App) deleteStream(stream *streamInfo) error {
+	if err := a.removeStream(stream); err != nil {
+		return err
+	}
+
+	var err error
+	stream.withStream(func() {
+		if stream.Type == twitchType {
+			err = a.unsubscribeTwitchStream(stream.UserId)
+		} else if stream.Type == youtubeType {
+			err = a.youtubeHubRequest(stream.UserId, "unsubscribe")
+		}
+	})
+	if err != nil {
+		log.Printf("Could not unsubscribe from %v: %v\n", stream.StreamName, err)
+	}
+	return nil
+}
+
+// unsubscribeTwitchStream deletes every EventSub subscription for a
+// broadcaster.
+func (a *App) unsubscribeTwitchStream(userID string) error {
+	if userID == "" {
+		return nil
+	}
+	subs, err := a.getSubscriptions("")
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs.Data {
+		if sub.Condition["broadcaster_user_id"] == userID {
+			if err = a.deleteSubscription(sub.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func streamTypeName(streamType int) string {
+	switch streamType {
+	case twitchType:
+		return "twitch"
+	case youtubeType:
+		return "youtube"
+	}
+	return "unknown"
+}
+
+func parseStreamType(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "twitch":
+		return twitchType, nil
+	case "youtube":
+		return youtubeType, nil
+	}
+	return 0, inputError(fmt.Sprintf("unknown stream type %q", name))
+}
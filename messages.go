@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	messageLogFile          string = "eventsub_messages.json"
+	defaultMessageRetention int64  = 3600
+	maxSeenMessages         int    = 10000
+
+	// messageLogSaveDelay is how long newly handled IDs may wait before the
+	// log is written, so a burst of messages is saved once.
+	messageLogSaveDelay = 5 * time.Second
+)
+
+// messageLog remembers the EventSub message IDs that have already been handled
+// so that retried deliveries are only acted on once. Entries older than the
+// retention window are dropped, and the log never holds more than limit IDs.
+// IDs being handled are held in inFlight, so a second delivery arriving
+// meanwhile is ignored but one arriving after a failure is not.
+type messageLog struct {
+	mu        sync.Mutex
+	path      string
+	retention time.Duration
+	limit     int
+	seen      map[string]int64
+	inFlight  map[string]bool
+	saveTimer *time.Timer
+}
+
+func loadMessageLog(path string, retention time.Duration, limit int) *messageLog {
+	messages := &messageLog{
+		path:      path,
+		retention: retention,
+		limit:     limit,
+		seen:      make(map[string]int64),
+		inFlight:  make(map[string]bool),
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Could not read %v, starting with an empty message log: %v\n", path, err)
+		}
+		return messages
+	}
+	if err = json.Unmarshal(content, &messages.seen); err != nil {
+		log.Printf("Could not parse %v, starting with an empty message log: %v\n", path, err)
+		messages.seen = make(map[string]int64)
+	}
+	messages.prune(time.Now())
+	return messages
+}
+
+// claim reports whether id should be handled: it has not been handled
+// before and is not being handled now. A claimed ID must be passed to finish.
+func (m *messageLog) claim(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.seen[id]; ok || m.inFlight[id] {
+		return false
+	}
+	m.inFlight[id] = true
+	return true
+}
+
+// finish ends the handling of a claimed id. Handled IDs are remembered and
+// saved shortly after; others are forgotten so a redelivery is handled.
+func (m *messageLog) finish(id string, handled bool, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.inFlight, id)
+	if !handled {
+		return
+	}
+	m.seen[id] = now.Unix()
+	m.prune(now)
+	if m.saveTimer == nil {
+		m.saveTimer = time.AfterFunc(messageLogSaveDelay, func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.saveTimer = nil
+			m.save()
+		})
+	}
+}
+
+// close saves any IDs still waiting to be written.
+func (m *messageLog) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.saveTimer != nil && m.saveTimer.Stop() {
+		m.saveTimer = nil
+		m.save()
+	}
+}
+
+func (m *messageLog) prune(now time.Time) {
+	cutoff := now.Add(-m.retention).Unix()
+	for id, seenAt := range m.seen {
+		if seenAt < cutoff {
+			delete(m.seen, id)
+		}
+	}
+
+	for len(m.seen) > m.limit {
+		var oldestID string
+		var oldest int64
+		for id, seenAt := range m.seen {
+			if oldestID == "" || seenAt < oldest {
+				oldestID, oldest = id, seenAt
+			}
+		}
+		delete(m.seen, oldestID)
+	}
+}
+
+func (m *messageLog) save() {
+	bytes, err := json.Marshal(m.seen)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err = writeFileAtomic(m.path, bytes, 0644, 0); err != nil {
+		log.Printf("Could not save message log: %v\n", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMessageLogDuplicates(t *testing.T) {
+	m := loadMessageLog(filepath.Join(t.TempDir(), messageLogFile), time.Hour, maxSeenMessages)
+	now := time.Now()
+
+	if !m.claim("message-1") {
+		t.Fatal("a new message was not claimed")
+	}
+	if m.claim("message-1") {
+		t.Error("a message being handled was claimed again")
+	}
+	m.finish("message-1", true, now)
+	if m.claim("message-1") {
+		t.Error("a handled message was claimed again")
+	}
+
+	if !m.claim("message-2") {
+		t.Fatal("a new message was not claimed")
+	}
+	m.finish("message-2", false, now)
+	if !m.claim("message-2") {
+		t.Error("a message that failed was not claimed when redelivered")
+	}
+}
+
+func TestMessageLogSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), messageLogFile)
+	m := loadMessageLog(path, time.Hour, maxSeenMessages)
+	m.claim("message-1")
+	m.finish("message-1", true, time.Now())
+	m.close()
+
+	m = loadMessageLog(path, time.Hour, maxSeenMessages)
+	if m.claim("message-1") {
+		t.Error("a message handled before the restart was claimed again")
+	}
+}
+
+func TestMessageLogPrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), messageLogFile)
+	m := loadMessageLog(path, time.Hour, 3)
+	now := time.Now()
+
+	m.claim("old")
+	m.finish("old", true, now.Add(-2*time.Hour))
+	for i := range 4 {
+		id := fmt.Sprintf("message-%d", i)
+		m.claim(id)
+		m.finish(id, true, now.Add(time.Duration(i)*time.Second))
+	}
+	if len(m.seen) != 3 {
+		t.Fatalf("log holds %v IDs, want 3", len(m.seen))
+	}
+	for _, id := range []string{"old", "message-0"} {
+		if _, ok := m.seen[id]; ok {
+			t.Errorf("%v was not pruned", id)
+		}
+	}
+	m.close()
+
+	m = loadMessageLog(path, time.Minute, 3)
+	if len(m.seen) != 3 {
+		t.Errorf("reloaded log holds %v IDs, want 3", len(m.seen))
+	}
+	m = loadMessageLog(path, time.Minute, 3)
+	m.prune(now.Add(time.Hour))
+	if len(m.seen) != 0 {
+		t.Errorf("log holds %v IDs past their retention", len(m.seen))
+	}
+}
+
+// TestMessageRetentionCoversSignatureWindow checks that message IDs are kept
+// for at least as long as a signed delivery can be replayed.
+func TestMessageRetentionCoversSignatureWindow(t *testing.T) {
+	fake := newFakeServices(t)
+	a := startTestApp(t, fake, nil, func(cfg *cofiguration) {
+		cfg.MessageRetention = 60
+	})
+	if got, want := a.config.MessageRetention, int64(eventSubMaxMessageAge/time.Second); got != want {
+		t.Errorf("message retention = %v, want %v", got, want)
+	}
+}
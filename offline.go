@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// endNotification edits the stream's announcements to say it has ended, with
+// how long it ran, its final title and category and, when vodURL is set, a
+// link to the recording. Each is rebuilt from the stream's and channel's
+// templates, so it keeps the look it was announced with. It runs on the
+// stream's event queue.
+func (a *App) endNotification(channel *streamInfo, vodURL string) {
+	user, game := a.twitchDetails(channel)
+	data := announcementFor(channel, user, game)
+	data.Ended = true
+	data.VOD = vodURL
+	if channel.StartedAt > 0 && channel.LastOffline > channel.StartedAt {
+		data.Duration = time.Duration(channel.LastOffline-channel.StartedAt) * time.Second
+	}
+
+	for _, target := range channel.Channels {
+		if target.MessageID == "" {
+			continue
+		}
+		message := a.announcement(channel, target, data)
+		_, err := a.discord.ChannelMessageEditComplex(&discordgo.MessageEdit{
+			ID:      target.MessageID,
+			Channel: target.ChannelID,
+			Content: &message.Content,
+			Embeds:  message.Embeds,
+		})
+		if err != nil {
+			log.Printf("Could not mark %v as ended in <#%v>: %v\n", channel.StreamName, target.ChannelID, err)
+		}
+	}
+}
+
+// endedLayout turns the default announcement embed into the ended one: the
+// ended wording, the offline banner in place of the stream preview, and the
+// duration and recording where they are known.
+func endedLayout(embed *discordgo.MessageEmbed, channel *streamInfo, data announcementData) {
+	embed.Description = fmt.Sprintf(broadcastWording(channel.BroadcastType).ended, data.Name)
+	embed.Image = nil
+	if data.OfflineImage != "" {
+		embed.Image = &discordgo.MessageEmbedImage{URL: data.OfflineImage}
+	}
+	if data.Duration > 0 {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   "Duration",
+			Value:  formatDuration(data.Duration),
+			Inline: true,
+		})
+	}
+	if data.VOD != "" {
+		embed.URL = data.VOD
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  "VOD",
+			Value: fmt.Sprintf("[Watch the recording](%v)", data.VOD),
+		})
+	}
+}
+
+// formatDuration writes d in hours and minutes, like "2h 5m".
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	if d < time.Hour {
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+	return fmt.Sprintf("%dh %dm", int(d.Hours()), int(d.Minutes())%60)
+}
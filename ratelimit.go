@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// helixDefaultLimit is Twitch's per-minute allowance for an app access
+	// token, used until a response tells us otherwise.
+	helixDefaultLimit = 800
+
+	// helixMaxRetries is how many times an idempotent request is retried
+	// after a 429, 5xx or network error, waiting helixRetryBackoff, doubled
+	// each time and jittered, in between.
+	helixMaxRetries   = 3
+	helixRetryBackoff = 500 * time.Millisecond
+)
+
+var errHelixClosed = errors.New("shutting down")
+
+// helixLimiter is a token bucket shared by every Helix request. Twitch
+// reports how many points are left and when the bucket refills with every
+// response, and the bucket is kept in step with that.
+type helixLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+func newHelixLimiter() *helixLimiter {
+	return &helixLimiter{
+		limit:     helixDefaultLimit,
+		remaining: helixDefaultLimit,
+		reset:     time.Now().Add(time.Minute),
+	}
+}
+
+// take waits until there is a point left in the bucket and uses it. It
+// reports whether it had to wait.
+func (l *helixLimiter) take(done <-chan struct{}) (bool, error) {
+	waited := false
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		if !now.Before(l.reset) {
+			l.remaining = l.limit
+			l.reset = now.Add(time.Minute)
+		}
+		if l.remaining > 0 {
+			l.remaining--
+			l.mu.Unlock()
+			return waited, nil
+		}
+		wait := l.reset.Sub(now)
+		l.mu.Unlock()
+
+		waited = true
+		select {
+		case <-time.After(wait):
+		case <-done:
+			return waited, errHelixClosed
+		}
+	}
+}
+
+// update takes the bucket's state from a response's Ratelimit headers.
+func (l *helixLimiter) update(header http.Header) {
+	limit, errLimit := strconv.Atoi(header.Get("Ratelimit-Limit"))
+	remaining, errRemaining := strconv.Atoi(header.Get("Ratelimit-Remaining"))
+	reset, errReset := strconv.ParseInt(header.Get("Ratelimit-Reset"), 10, 64)
+	if errRemaining != nil || errReset != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if errLimit == nil && limit > 0 {
+		l.limit = limit
+	}
+	l.remaining = remaining
+	l.reset = time.Unix(reset, 0)
+}
+
+// exhaust empties the bucket after a 429, so requests wait for the reset
+// even if the response did not say when that is.
+func (l *helixLimiter) exhaust() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.remaining = 0
+	if !l.reset.After(time.Now()) {
+		l.reset = time.Now().Add(time.Second)
+	}
+}
+
+// helixStats counts Helix requests since the bot started.
+type helixStats struct {
+	requests  atomic.Uint64
+	throttled atomic.Uint64
+	retries   atomic.Uint64
+	failed    atomic.Uint64
+}
+
+// helixStatus is the rate limit state and request counters shown by the API.
+type helixStatus struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+	Requests  uint64    `json:"requests"`
+	Throttled uint64    `json:"throttled"`
+	Retries   uint64    `json:"retries"`
+	Failed    uint64    `json:"failed"`
+}
+
+func (h *helixClient) status() helixStatus {
+	h.limiter.mu.Lock()
+	status := helixStatus{
+		Limit:     h.limiter.limit,
+		Remaining: h.limiter.remaining,
+		Reset:     h.limiter.reset.UTC(),
+	}
+	h.limiter.mu.Unlock()
+	status.Requests = h.stats.requests.Load()
+	status.Throttled = h.stats.throttled.Load()
+	status.Retries = h.stats.retries.Load()
+	status.Failed = h.stats.failed.Load()
+	return status
+}
+
+// retryBackoff is how long to wait before retry number attempt, starting at
+// zero: helixRetryBackoff doubled each time, give or take half.
+func retryBackoff(attempt int) time.Duration {
+	backoff := helixRetryBackoff << attempt
+	return backoff/2 + rand.N(backoff)
+}
+
+func (a *App) handleAPIHelixStatus(w http.ResponseWriter, r *http.Request) error {
+	writeJSON(w, http.StatusOK, a.helix.status())
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// defaultSubscriptionSync is how often, in seconds, subscriptions are
+// reconciled when the config does not say.
+const defaultSubscriptionSync int64 = 900
+
+// subscriptionKey is one subscription a tracked stream needs.
+type subscriptionKey struct {
+	userID    string
+	eventType string
+}
+
+// runSubscriptionSync reconciles subscriptions every SubscriptionSync seconds
+// until the App is closed.
+func (a *App) runSubscriptionSync() {
+	ticker := time.NewTicker(time.Duration(a.config.SubscriptionSync) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.reconcileSubscriptions()
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// reconcileSubscriptions makes our EventSub subscriptions match the Twitch
+// streams we track. Every stream needs each of twitchEventTypes delivered to
+// our current transport; missing ones are created, and subscriptions of ours
+// that failed, are duplicates, use the other transport or an old session, or
+// belong to streams we no longer track are deleted. Subscriptions other
+// deployments made with our client ID are left alone. Webhook subscriptions
+// made with the previous EventSub secret are replaced one at a time. It
+// reports whether every stream has all its subscriptions and none is left on
+// the previous secret.
+func (a *App) reconcileSubscriptions() bool {
+	a.reconcileMu.Lock()
+	defer a.reconcileMu.Unlock()
+
+	current, err := a.eventSubTransport()
+	if err != nil {
+		log.Printf("Not reconciling subscriptions: %v\n", err)
+		return false
+	}
+
+	// Subscriptions are listed before the streams are, so one made for a
+	// stream added in between is not taken for an orphan.
+	subs, err := a.getSubscriptions("")
+	if err != nil {
+		log.Printf("Not reconciling subscriptions: %v\n", err)
+		return false
+	}
+
+	streams := make(map[string]*streamInfo)
+	desired := make(map[subscriptionKey]bool)
+	for _, stream := range a.allStreams() {
+		stream.withStream(func() {
+			if stream.Type != twitchType || stream.UserId == "" {
+				return
+			}
+			streams[stream.UserId] = stream
+			for _, eventType := range twitchEventTypes {
+				desired[subscriptionKey{stream.UserId, eventType}] = true
+			}
+		})
+	}
+
+	var deleted, created int
+	failed := make(map[string]bool)
+	replaced := true
+	satisfied := make(map[subscriptionKey]bool)
+	for _, sub := range subs.Data {
+		key := subscriptionKey{sub.Condition["broadcaster_user_id"], sub.Type}
+		reason := ""
+		_, tracked := streams[key.userID]
+		switch {
+		case !a.ownsSubscription(sub, current, tracked):
+			// Made by another deployment using our client ID.
+			continue
+		case sub.Status != "enabled" && sub.Status != "webhook_callback_verification_pending":
+			reason = sub.Status
+		case !deliversTo(sub, current):
+			reason = "stale transport"
+		case a.madeWithPreviousSecret(sub):
+			reason = "previous secret"
+		case !desired[key]:
+			reason = "not tracked"
+		case satisfied[key]:
+			reason = "duplicate"
+		}
+		if reason != "" {
+			log.Printf("Deleting %v subscription %v for %v: %v\n", sub.Type, sub.ID, key.userID, reason)
+			if err := a.deleteSubscription(sub.ID); err != nil {
+				log.Println(err)
+				replaced = replaced && reason != "previous secret"
+				continue
+			}
+			if sub.Status == "enabled" || sub.Status == "webhook_callback_verification_pending" {
+				a.releaseSubscriptionCost(sub.Cost)
+			}
+			deleted++
+			if reason == "previous secret" && desired[key] && !satisfied[key] {
+				// Recreated straight away, so its events are only missed
+				// for the moment between the two requests.
+				if err := a.registerTwitchSubscription(key.userID, key.eventType); err != nil {
+					log.Printf("Could not create %v subscription for %v: %v\n", key.eventType, key.userID, err)
+					failed[key.userID] = true
+				} else {
+					created++
+				}
+				satisfied[key] = true
+			}
+			continue
+		}
+		satisfied[key] = true
+	}
+
+	// stream.online is created first, so that when the budget runs short it
+	// goes to announcements rather than the optional event types.
+	var missing []subscriptionKey
+	for key := range desired {
+		if !satisfied[key] {
+			missing = append(missing, key)
+		}
+	}
+	sortSubscriptionKeys(missing)
+
+	for _, key := range missing {
+		if err := a.registerTwitchSubscription(key.userID, key.eventType); err != nil {
+			log.Printf("Could not create %v subscription for %v: %v\n", key.eventType, key.userID, err)
+			failed[key.userID] = true
+			continue
+		}
+		created++
+	}
+
+	for userID, stream := range streams {
+		stream.withStream(func() {
+			if stream.Unsubscribed != failed[userID] {
+				stream.Unsubscribed = failed[userID]
+				a.saveStream(stream)
+			}
+		})
+	}
+	budget := a.subscriptionBudget()
+	log.Printf("Reconciled subscriptions: %v wanted, %v created, %v deleted, cost %v of %v\n", len(desired), created, deleted, budget.TotalCost, budget.MaxTotalCost)
+	return len(failed) == 0 && replaced
+}
+
+// subscribeSession subscribes a new WebSocket session to every event of the
+// Twitch streams we track. Twitch closes a session that has no subscriptions
+// soon after welcoming it, so this neither lists the existing subscriptions
+// nor waits for a reconcile already running; a full reconcile follows to
+// clean up after the previous session.
+func (a *App) subscribeSession(sessionID string) {
+	var missing []subscriptionKey
+	for _, stream := range a.allStreams() {
+		stream.withStream(func() {
+			if stream.Type != twitchType || stream.UserId == "" {
+				return
+			}
+			for _, eventType := range twitchEventTypes {
+				missing = append(missing, subscriptionKey{stream.UserId, eventType})
+			}
+		})
+	}
+	sortSubscriptionKeys(missing)
+
+	a.resetSubscriptionCost()
+	for _, key := range missing {
+		if a.eventSubSession() != sessionID {
+			return
+		}
+		if err := a.registerTwitchSubscription(key.userID, key.eventType); err != nil {
+			log.Printf("Could not create %v subscription for %v: %v\n", key.eventType, key.userID, err)
+		}
+	}
+	a.reconcileSubscriptions()
+}
+
+// sortSubscriptionKeys puts stream.online first, so that when the budget runs
+// short it goes to announcements rather than the optional event types.
+func sortSubscriptionKeys(keys []subscriptionKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		iOnline, jOnline := keys[i].eventType == "stream.online", keys[j].eventType == "stream.online"
+		if iOnline != jOnline {
+			return iOnline
+		}
+		if keys[i].userID != keys[j].userID {
+			return keys[i].userID < keys[j].userID
+		}
+		return keys[i].eventType < keys[j].eventType
+	})
+}
+
+// ownsSubscription reports whether sub was made by this bot rather than by
+// another deployment sharing the client ID: a webhook delivering to our
+// callback, even once we have moved to the WebSocket transport, or a
+// WebSocket subscription on our current session or, while we use WebSockets,
+// for a broadcaster we track.
+func (a *App) ownsSubscription(sub subscriptionInfo, current transport, tracked bool) bool {
+	switch sub.Transport["method"] {
+	case webhookTransport:
+		return a.config.Secrets.BaseUrl != "" && sub.Transport["callback"] == a.webhookCallback()
+	case websocketTransport:
+		if current.Method != websocketTransport {
+			return false
+		}
+		return sub.Transport["session_id"] == current.SessionID || tracked
+	}
+	return false
+}
+
+// madeWithPreviousSecret reports whether sub is a webhook subscription created
+// before the current EventSub secret, while the previous one is still kept.
+func (a *App) madeWithPreviousSecret(sub subscriptionInfo) bool {
+	a.configMu.Lock()
+	previous, since := a.config.Secrets.PreviousEventSubSecret, a.config.Secrets.EventSubSecretCreated
+	a.configMu.Unlock()
+	if previous == "" || sub.Transport["method"] != webhookTransport {
+		return false
+	}
+	created, err := time.Parse(time.RFC3339Nano, sub.CreatedAt)
+	secretCreated, secretErr := time.Parse(time.RFC3339Nano, since)
+	return err != nil || secretErr != nil || created.Before(secretCreated)
+}
+
+// deliversTo reports whether sub sends its events to t.
+func deliversTo(sub subscriptionInfo, t transport) bool {
+	if t.Method == websocketTransport {
+		return sub.Transport["session_id"] == t.SessionID
+	}
+	return sub.Transport["callback"] == t.Callback
+}
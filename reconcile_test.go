@@ -0,0 +1,56 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestReconcileLeavesOtherDeployments checks that reconcile only deletes
+// subscriptions of ours, and leaves those that another deployment sharing the
+// client ID made, even failed ones.
+func TestReconcileLeavesOtherDeployments(t *testing.T) {
+	fake := newFakeServices(t)
+	fake.addUser("1", "streamer1")
+	ours := map[string]string{"method": webhookTransport, "callback": "https://paintbot.example.com/notify"}
+	theirs := map[string]string{"method": webhookTransport, "callback": "https://other.example.com/notify"}
+	created := time.Now().UTC().Format(time.RFC3339Nano)
+	fake.mu.Lock()
+	fake.subscriptions = append(fake.subscriptions,
+		subscriptionInfo{ID: "ours-failed", Status: "notification_failures_exceeded", Type: "stream.online", Condition: map[string]string{"broadcaster_user_id": "1"}, Transport: ours, CreatedAt: created},
+		subscriptionInfo{ID: "ours-untracked", Status: "enabled", Type: "stream.online", Condition: map[string]string{"broadcaster_user_id": "9"}, Transport: ours, CreatedAt: created},
+		subscriptionInfo{ID: "theirs", Status: "enabled", Type: "stream.online", Condition: map[string]string{"broadcaster_user_id": "9"}, Transport: theirs, CreatedAt: created},
+		subscriptionInfo{ID: "theirs-failed", Status: "notification_failures_exceeded", Type: "stream.online", Condition: map[string]string{"broadcaster_user_id": "1"}, Transport: theirs, CreatedAt: created},
+	)
+	fake.mu.Unlock()
+
+	startTestApp(t, fake, []*streamInfo{{
+		StreamName:   "streamer1",
+		UserId:       "1",
+		ColourString: "0x9146FF",
+		Type:         twitchType,
+		Channels:     []discordChannel{{ChannelID: "201"}},
+	}}, nil)
+
+	var ids []string
+	var mine int
+	for _, sub := range fake.currentSubscriptions() {
+		ids = append(ids, sub.ID)
+		if sub.Transport["callback"] == ours["callback"] && sub.Condition["broadcaster_user_id"] == "1" {
+			mine++
+		}
+	}
+	for _, id := range []string{"ours-failed", "ours-untracked"} {
+		if slices.Contains(ids, id) {
+			t.Errorf("subscription %v was not deleted", id)
+		}
+	}
+	for _, id := range []string{"theirs", "theirs-failed"} {
+		if !slices.Contains(ids, id) {
+			t.Errorf("another deployment's subscription %v was deleted", id)
+		}
+	}
+	if mine != len(twitchEventTypes) {
+		t.Errorf("%v subscriptions to our callback for streamer1, want %v", mine, len(twitchEventTypes))
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// minLiveRefresh is the shortest refresh interval, in seconds, a stream
+	// may have. Edits go through discordgo's rate limiter, which waits out
+	// Discord's per-channel limits, and this keeps them well inside those.
+	minLiveRefresh int64 = 60
+
+	// liveRefreshTick is how often the scheduler looks for live streams due
+	// a refresh.
+	liveRefreshTick = 15 * time.Second
+)
+
+// runLiveRefresh refreshes the announcements of live streams until the App
+// is closed.
+func (a *App) runLiveRefresh() {
+	ticker := time.NewTicker(liveRefreshTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.refreshLiveStreams()
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// refreshLiveStreams looks up every live stream due a refresh in one Helix
+// request and edits their announcements with the viewer count, uptime and a
+// new thumbnail. Streams with a summary have their viewers sampled even if
+// their announcement is not refreshed; the samples are only kept in memory
+// until the stream is next saved, at the latest when it goes offline. The
+// edit is queued behind the stream's other events, so a stream that went
+// offline in the meantime is left alone.
+func (a *App) refreshLiveStreams() {
+	now := time.Now()
+	due := make(map[string]*streamInfo)
+	var userIDs []string
+	for _, stream := range a.allStreams() {
+		stream.withStream(func() {
+			if stream.Type != twitchType || !stream.IsLive || stream.UserId == "" {
+				return
+			}
+			interval := time.Duration(stream.RefreshInterval) * time.Second
+			if stream.RefreshInterval <= 0 {
+				if stream.Timeline == nil {
+					return
+				}
+				interval = time.Duration(defaultSampleInterval) * time.Second
+			}
+			if stream.nextRefresh.IsZero() {
+				stream.nextRefresh = now.Add(interval)
+				return
+			}
+			if now.Before(stream.nextRefresh) {
+				return
+			}
+			stream.nextRefresh = now.Add(interval)
+			due[stream.UserId] = stream
+			userIDs = append(userIDs, stream.UserId)
+		})
+	}
+	if len(userIDs) == 0 {
+		return
+	}
+
+	live, err := a.helix.Streams(userIDs)
+	if err != nil {
+		log.Printf("Could not refresh live streams: %v\n", err)
+		return
+	}
+	for userID, stream := range due {
+		info, ok := live[userID]
+		if !ok {
+			// Gone offline; stream.offline will follow.
+			continue
+		}
+		stream.dispatch(func() {
+			if !stream.IsLive {
+				return
+			}
+			stream.viewers = info.ViewerCount
+			if stream.Timeline != nil {
+				stream.Timeline.sample(info.ViewerCount)
+			}
+			if stream.RefreshInterval > 0 {
+				a.postNotification(stream)
+			}
+		})
+	}
+}
+
+// liveFields are the embed fields showing how a live stream is doing.
+func liveFields(channel *streamInfo) []*discordgo.MessageEmbedField {
+	var fields []*discordgo.MessageEmbedField
+	if channel.viewers > 0 {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   "Viewers",
+			Value:  strconv.Itoa(channel.viewers),
+			Inline: true,
+		})
+	}
+	if channel.StartedAt > 0 {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   "Uptime",
+			Value:  formatDuration(time.Since(time.Unix(channel.StartedAt, 0))),
+			Inline: true,
+		})
+	}
+	return fields
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"strings"
+)
+
+// streamEventQueueSize is how many events can wait for a single stream before
+// more are dropped.
+const streamEventQueueSize = 64
+
+// allStreams returns a copy of the tracked streams, safe to range over while
+// streams are added or removed.
+func (a *App) allStreams() []*streamInfo {
+	a.streamsMu.RLock()
+	defer a.streamsMu.RUnlock()
+	return append([]*streamInfo(nil), a.config.Streams...)
+}
+
+// addStream starts tracking a new stream and saves it.
+func (a *App) addStream(stream *streamInfo) error {
+	if err := a.store.SaveStream(stream); err != nil {
+		return err
+	}
+	a.streamsMu.Lock()
+	stream.lookupName, stream.lookupID = stream.StreamName, stream.UserId
+	a.config.Streams = append(a.config.Streams, stream)
+	a.streamsMu.Unlock()
+	return nil
+}
+
+// indexStream updates the name and user ID findChannel knows the stream by,
+// after they change. The stream must be locked.
+func (a *App) indexStream(stream *streamInfo) {
+	a.streamsMu.Lock()
+	stream.lookupName, stream.lookupID = stream.StreamName, stream.UserId
+	a.streamsMu.Unlock()
+}
+
+// removeStream stops tracking a stream and deletes it from the store.
+func (a *App) removeStream(stream *streamInfo) error {
+	a.streamsMu.Lock()
+	for i, existing := range a.config.Streams {
+		if existing == stream {
+			a.config.Streams = append(a.config.Streams[:i:i], a.config.Streams[i+1:]...)
+			break
+		}
+	}
+	a.streamsMu.Unlock()
+	stream.stopEvents()
+
+	var err error
+	stream.withStream(func() {
+		err = a.store.DeleteStream(stream)
+	})
+	return err
+}
+
+// tracking reports whether stream is still one of the tracked streams.
+func (a *App) tracking(stream *streamInfo) bool {
+	a.streamsMu.RLock()
+	defer a.streamsMu.RUnlock()
+	for _, existing := range a.config.Streams {
+		if existing == stream {
+			return true
+		}
+	}
+	return false
+}
+
+// findStream returns the tracked stream with the given store ID.
+func (a *App) findStream(id int64) *streamInfo {
+	for _, stream := range a.allStreams() {
+		if stream.ID == id {
+			return stream
+		}
+	}
+	return nil
+}
+
+// displayName is how the stream is named in announcements: the broadcaster's
+// display name where Twitch has told us one, otherwise the configured name.
+func (s *streamInfo) displayName() string {
+	if s.DisplayName != "" {
+		return s.DisplayName
+	}
+	return s.StreamName
+}
+
+// setTwitchNames records the broadcaster's current login and display name,
+// which change when they rename themselves, and reports whether either did.
+// Empty values are ignored. The stream must be locked.
+func (s *streamInfo) setTwitchNames(login string, displayName string) bool {
+	changed := false
+	if login = strings.ToLower(login); login != "" && login != s.StreamName {
+		log.Printf("Twitch user %v is now %v\n", s.StreamName, login)
+		s.StreamName = login
+		changed = true
+	}
+	if displayName != "" && displayName != s.DisplayName {
+		s.DisplayName = displayName
+		changed = true
+	}
+	return changed
+}
+
+// findChannel returns the tracked stream of channelType with the given name or
+// user ID. It only takes streamsMu, so it never waits for a stream's events.
+func (a *App) findChannel(name string, channelType int) (channel *streamInfo) {
+	a.streamsMu.RLock()
+	defer a.streamsMu.RUnlock()
+	for _, currChannel := range a.config.Streams {
+		if currChannel.Type != channelType {
+			continue
+		}
+		if strings.EqualFold(currChannel.lookupName, name) || strings.EqualFold(currChannel.lookupID, name) {
+			return currChannel
+		}
+	}
+	return nil
+}
+
+// dispatch queues fn to run with the stream locked, once every event queued for
+// the same stream before it has been applied. Events for different streams run
+// concurrently. It never waits: events for a stream that has been removed, or
+// whose queue is full, are dropped, so the webhook and WebSocket handlers are
+// never held up by one slow stream. It reports whether fn was queued.
+func (s *streamInfo) dispatch(fn func()) bool {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if s.stopped {
+		return false
+	}
+	if s.events == nil {
+		s.events = make(chan func(), streamEventQueueSize)
+		go s.runEvents()
+	}
+	select {
+	case s.events <- fn:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopEvents lets the stream's queue drain and then ends it.
+func (s *streamInfo) stopEvents() {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if !s.stopped && s.events != nil {
+		close(s.events)
+	}
+	s.stopped = true
+}
+
+func (s *streamInfo) runEvents() {
+	for fn := range s.events {
+		s.runEvent(fn)
+	}
+}
+
+func (s *streamInfo) runEvent(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Handling event for %v panicked: %v\n%s", s.StreamName, r, debug.Stack())
+		}
+	}()
+	fn()
+}
+
+// withStream runs fn with the stream locked, for work outside the event queue
+// such as startup registration.
+func (s *streamInfo) withStream(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	jsonStorage   string = "json"
+	sqliteStorage string = "sqlite"
+
+	defaultDatabaseFile string = "paintbot.db"
+)
+
+// Store persists the streams the bot tracks and what it has posted for them.
+// Callers keep working on the in-memory *streamInfo values and tell the store
+// which parts changed, holding the stream's lock while they do. Stores must not
+// keep the pointers they are given.
+type Store interface {
+	// LoadStreams returns every stored stream with its Discord targets and
+	// posted video IDs.
+	LoadStreams() ([]*streamInfo, error)
+	// SaveStream creates or updates a stream along with its Discord targets
+	// and video IDs, assigning stream.ID for new streams.
+	SaveStream(stream *streamInfo) error
+	// DeleteStream removes a stream and everything stored for it.
+	DeleteStream(stream *streamInfo) error
+	// SetMessageID records the message posted for a stream in a Discord channel.
+	SetMessageID(stream *streamInfo, channelID string, messageID string) error
+	// AddVideoID records a YouTube video as posted for a stream.
+	AddVideoID(stream *streamInfo, videoID string) error
+	Close() error
+}
+
+// openStore opens the configured storage backend, moving the streams from
+// cfg.txt into it the first time a database backend is used.
+func (a *App) openStore() (Store, error) {
+	switch a.config.Storage {
+	case jsonStorage:
+		return &jsonStore{initial: a.config.Streams, write: a.writeConfig}, nil
+	case "", sqliteStorage:
+		path := a.config.Database
+		if path == "" {
+			path = defaultDatabaseFile
+		}
+		s, err := openSQLiteStore(a.dataPath(path))
+		if err != nil {
+			return nil, err
+		}
+		if err = a.migrateConfigStreams(s); err != nil {
+			s.Close()
+			return nil, err
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", a.config.Storage)
+	}
+}
+
+// migrateConfigStreams copies the streams still held in cfg.txt into s and
+// rewrites cfg.txt without them. A copy of the old file is kept next to it.
+// The streams are saved in one transaction, so a failed migration leaves the
+// database empty and is tried again in full on the next start.
+func (a *App) migrateConfigStreams(s *sqliteStore) error {
+	if len(a.config.Streams) == 0 {
+		return nil
+	}
+
+	existing, err := s.LoadStreams()
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		log.Printf("Database already holds %d streams, ignoring the %d in %v\n", len(existing), len(a.config.Streams), a.cfgPath)
+		return nil
+	}
+
+	log.Printf("Migrating %d streams from %v\n", len(a.config.Streams), a.cfgPath)
+	content, err := os.ReadFile(a.cfgPath)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(a.cfgPath+".pre-sqlite", content, 0600, 0); err != nil {
+		return err
+	}
+
+	for _, stream := range a.config.Streams {
+		stream.ID = 0
+	}
+	if err = s.saveStreams(a.config.Streams); err != nil {
+		return err
+	}
+	a.config.Streams = nil
+	a.writeConfig()
+	return nil
+}
+
+// jsonStore is the legacy backend, which keeps the streams in cfg.txt and
+// rewrites the whole file on every change. It writes from its own copy of each
+// stream, taken while the caller holds the stream's lock, so that saving one
+// stream never reads another that is being changed.
+type jsonStore struct {
+	initial []*streamInfo
+	write   func()
+
+	mu      sync.Mutex
+	nextID  int64
+	order   []int64
+	streams map[int64][]byte
+}
+
+func (s *jsonStore) LoadStreams() ([]*streamInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.order = nil
+	s.streams = make(map[int64][]byte)
+	for _, stream := range s.initial {
+		if stream.ID > s.nextID {
+			s.nextID = stream.ID
+		}
+	}
+	for _, stream := range s.initial {
+		if stream.ID == 0 {
+			s.nextID++
+			stream.ID = s.nextID
+		}
+		if err := s.copyStream(stream); err != nil {
+			return nil, err
+		}
+	}
+	return s.initial, nil
+}
+
+// copyStream records the current state of stream. s.mu must be held.
+func (s *jsonStore) copyStream(stream *streamInfo) error {
+	bytes, err := json.Marshal(stream)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.streams[stream.ID]; !ok {
+		s.order = append(s.order, stream.ID)
+	}
+	s.streams[stream.ID] = bytes
+	return nil
+}
+
+// snapshot returns the streams as they were last saved, for writing to
+// cfg.txt.
+func (s *jsonStore) snapshot() []*streamInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	streams := make([]*streamInfo, 0, len(s.order))
+	for _, id := range s.order {
+		stream := &streamInfo{}
+		if err := json.Unmarshal(s.streams[id], stream); err != nil {
+			log.Println(err)
+			continue
+		}
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+func (s *jsonStore) save(stream *streamInfo) error {
+	s.mu.Lock()
+	if stream.ID == 0 {
+		s.nextID++
+		stream.ID = s.nextID
+	}
+	err := s.copyStream(stream)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.write()
+	return nil
+}
+
+func (s *jsonStore) SaveStream(stream *streamInfo) error {
+	return s.save(stream)
+}
+
+func (s *jsonStore) DeleteStream(stream *streamInfo) error {
+	s.mu.Lock()
+	delete(s.streams, stream.ID)
+	for i, id := range s.order {
+		if id == stream.ID {
+			s.order = append(s.order[:i:i], s.order[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+	s.write()
+	return nil
+}
+
+func (s *jsonStore) SetMessageID(stream *streamInfo, channelID string, messageID string) error {
+	return s.save(stream)
+}
+
+func (s *jsonStore) AddVideoID(stream *streamInfo, videoID string) error {
+	return s.save(stream)
+}
+
+func (s *jsonStore) Close() error {
+	return nil
+}
+
+// streamData is the JSON stored for a stream's settings and state, without
+// the parts that have their own tables.
+func streamData(stream *streamInfo) ([]byte, error) {
+	bytes, err := json.Marshal(stream)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(bytes, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "id")
+	delete(fields, "discord_channel_ids")
+	delete(fields, "video_ids")
+	return json.Marshal(fields)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order, with PRAGMA user_version recording
+// how many have already run.
+var sqliteMigrations = []string{
+	`CREATE TABLE streams (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type INTEGER NOT NULL,
+		stream_name TEXT NOT NULL,
+		user_id TEXT NOT NULL DEFAULT '',
+		data TEXT NOT NULL
+	);
+	CREATE TABLE discord_targets (
+		stream_id INTEGER NOT NULL REFERENCES streams(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		channel_id TEXT NOT NULL,
+		message_id TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (stream_id, channel_id)
+	);
+	CREATE TABLE videos (
+		stream_id INTEGER NOT NULL REFERENCES streams(id) ON DELETE CASCADE,
+		video_id TEXT NOT NULL,
+		posted_at INTEGER NOT NULL,
+		PRIMARY KEY (stream_id, video_id)
+	);`,
+	`ALTER TABLE discord_targets ADD COLUMN filter TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE discord_targets ADD COLUMN template TEXT NOT NULL DEFAULT '';`,
+}
+
+// sqliteStore keeps streams in an embedded SQLite database. Stream settings are
+// stored as JSON, with Discord targets and videos in their own tables so that
+// posting a message or a video only touches one row.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	s := &sqliteStore{db: db}
+	if err = s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqliteStore) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(sqliteMigrations[version]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		// PRAGMA does not accept bound parameters.
+		if _, err = tx.Exec("PRAGMA user_version = " + strconv.Itoa(version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) LoadStreams() ([]*streamInfo, error) {
+	rows, err := s.db.Query("SELECT id, data FROM streams ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var streams []*streamInfo
+	byID := make(map[int64]*streamInfo)
+	for rows.Next() {
+		var id int64
+		var data string
+		if err = rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		stream := &streamInfo{}
+		if err = json.Unmarshal([]byte(data), stream); err != nil {
+			return nil, err
+		}
+		stream.ID = id
+		streams = append(streams, stream)
+		byID[id] = stream
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	targets, err := s.db.Query("SELECT stream_id, channel_id, message_id, filter, template FROM discord_targets ORDER BY stream_id, position")
+	if err != nil {
+		return nil, err
+	}
+	defer targets.Close()
+	for targets.Next() {
+		var id int64
+		var target discordChannel
+		var filter, tmpl string
+		if err = targets.Scan(&id, &target.ChannelID, &target.MessageID, &filter, &tmpl); err != nil {
+			return nil, err
+		}
+		if filter != "" {
+			target.Filter = &channelFilter{}
+			if err = json.Unmarshal([]byte(filter), target.Filter); err != nil {
+				return nil, err
+			}
+		}
+		if tmpl != "" {
+			target.Template = &announcementTemplate{}
+			if err = json.Unmarshal([]byte(tmpl), target.Template); err != nil {
+				return nil, err
+			}
+		}
+		if stream, ok := byID[id]; ok {
+			stream.Channels = append(stream.Channels, target)
+		}
+	}
+	if err = targets.Err(); err != nil {
+		return nil, err
+	}
+
+	videos, err := s.db.Query("SELECT stream_id, video_id FROM videos ORDER BY stream_id, posted_at")
+	if err != nil {
+		return nil, err
+	}
+	defer videos.Close()
+	for videos.Next() {
+		var id int64
+		var video string
+		if err = videos.Scan(&id, &video); err != nil {
+			return nil, err
+		}
+		if stream, ok := byID[id]; ok {
+			stream.VideoIds = append(stream.VideoIds, video)
+		}
+	}
+	return streams, videos.Err()
+}
+
+func (s *sqliteStore) SaveStream(stream *streamInfo) error {
+	return s.saveStreams([]*streamInfo{stream})
+}
+
+// saveStreams saves every stream in one transaction, so either all of them are
+// stored or none are.
+func (s *sqliteStore) saveStreams(streams []*streamInfo) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stream := range streams {
+		if err = saveStream(tx, stream); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func saveStream(tx *sql.Tx, stream *streamInfo) error {
+	data, err := streamData(stream)
+	if err != nil {
+		return err
+	}
+
+	if stream.ID == 0 {
+		res, err := tx.Exec("INSERT INTO streams (type, stream_name, user_id, data) VALUES (?, ?, ?, ?)",
+			stream.Type, stream.StreamName, stream.UserId, string(data))
+		if err != nil {
+			return err
+		}
+		if stream.ID, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	} else {
+		_, err = tx.Exec(`INSERT INTO streams (id, type, stream_name, user_id, data) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET type = excluded.type, stream_name = excluded.stream_name,
+			user_id = excluded.user_id, data = excluded.data`,
+			stream.ID, stream.Type, stream.StreamName, stream.UserId, string(data))
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.Exec("DELETE FROM discord_targets WHERE stream_id = ?", stream.ID); err != nil {
+		return err
+	}
+	for i, target := range stream.Channels {
+		var filter, tmpl []byte
+		if target.Filter != nil {
+			if filter, err = json.Marshal(target.Filter); err != nil {
+				return err
+			}
+		}
+		if target.Template != nil {
+			if tmpl, err = json.Marshal(target.Template); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec("INSERT OR REPLACE INTO discord_targets (stream_id, position, channel_id, message_id, filter, template) VALUES (?, ?, ?, ?, ?, ?)",
+			stream.ID, i, target.ChannelID, target.MessageID, string(filter), string(tmpl))
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().Unix()
+	for i, video := range stream.VideoIds {
+		// Keep the existing order when videos are stored for the first time.
+		_, err = tx.Exec("INSERT OR IGNORE INTO videos (stream_id, video_id, posted_at) VALUES (?, ?, ?)",
+			stream.ID, video, now-int64(len(stream.VideoIds)-i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) DeleteStream(stream *streamInfo) error {
+	_, err := s.db.Exec("DELETE FROM streams WHERE id = ?", stream.ID)
+	return err
+}
+
+func (s *sqliteStore) SetMessageID(stream *streamInfo, channelID string, messageID string) error {
+	_, err := s.db.Exec("UPDATE discord_targets SET message_id = ? WHERE stream_id = ? AND channel_id = ?",
+		messageID, stream.ID, channelID)
+	return err
+}
+
+func (s *sqliteStore) AddVideoID(stream *streamInfo, videoID string) error {
+	_, err := s.db.Exec("INSERT OR IGNORE INTO videos (stream_id, video_id, posted_at) VALUES (?, ?, ?)",
+		stream.ID, videoID, time.Now().Unix())
+	return err
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
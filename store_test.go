@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMigrateConfigStreamsAllOrNothing checks that a migration failing part
+// way stores nothing, so the next start migrates every stream.
+func TestMigrateConfigStreamsAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	streams := func() []*streamInfo {
+		return []*streamInfo{
+			{StreamName: "first", UserId: "1", Type: twitchType, Channels: []discordChannel{{ChannelID: "201"}}},
+			{StreamName: "second", UserId: "2", Type: twitchType, Channels: []discordChannel{{ChannelID: "202"}}},
+			{StreamName: "third", UserId: "3", Type: twitchType, Channels: []discordChannel{{ChannelID: "203"}}},
+		}
+	}
+	cfg := cofiguration{Streams: streams()}
+	content, _ := json.Marshal(cfg)
+	cfgPath := filepath.Join(dir, "cfg.txt")
+	if err := os.WriteFile(cfgPath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openSQLiteStore(filepath.Join(dir, defaultDatabaseFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, err = s.db.Exec(`CREATE TRIGGER fail_second BEFORE INSERT ON streams WHEN NEW.stream_name = 'second'
+		BEGIN SELECT RAISE(ABORT, 'disk on fire'); END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &App{cfgPath: cfgPath, config: &cofiguration{Streams: streams(), ConfigBackups: defaultConfigBackups}}
+	if err = a.migrateConfigStreams(s); err == nil {
+		t.Fatal("migration succeeded despite the failing insert")
+	}
+	if stored, _ := s.LoadStreams(); len(stored) != 0 {
+		t.Fatalf("failed migration stored %d streams", len(stored))
+	}
+
+	if _, err = s.db.Exec("DROP TRIGGER fail_second"); err != nil {
+		t.Fatal(err)
+	}
+	a = &App{cfgPath: cfgPath, config: &cofiguration{Streams: streams(), ConfigBackups: defaultConfigBackups}}
+	if err = a.migrateConfigStreams(s); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.LoadStreams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 3 {
+		t.Fatalf("retried migration stored %d streams, want 3", len(stored))
+	}
+
+	var rewritten cofiguration
+	content, _ = os.ReadFile(cfgPath)
+	if err = json.Unmarshal(content, &rewritten); err != nil || len(rewritten.Streams) != 0 {
+		t.Errorf("cfg.txt still holds %d streams (%v)", len(rewritten.Streams), err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// defaultSampleInterval is how often, in seconds, viewers are sampled for the
+// summary of a stream that does not have its announcement refreshed.
+const defaultSampleInterval int64 = 300
+
+// streamTimeline is what happened during one broadcast, kept for its
+// end-of-stream summary. It survives restarts with the rest of the stream,
+// less any viewer samples taken since the stream was last saved, and is
+// replaced when the next broadcast starts.
+type streamTimeline struct {
+	StreamID  string `json:"stream_id"`
+	StartedAt int64  `json:"started_at"`
+	EndedAt   int64  `json:"ended_at,omitempty"`
+
+	// Viewer counts sampled while live.
+	PeakViewers  int   `json:"peak_viewers"`
+	ViewerTotal  int64 `json:"viewer_total"`
+	ViewerCounts int   `json:"viewer_samples"`
+
+	Categories []timelineEntry `json:"categories"`
+	Titles     []timelineEntry `json:"titles"`
+
+	// Messages are the summaries posted, so a later one edits them.
+	Messages []discordChannel `json:"messages,omitempty"`
+}
+
+// timelineEntry is a category or title, and when it was first seen.
+type timelineEntry struct {
+	Value string `json:"value"`
+	At    int64  `json:"at"`
+}
+
+// startTimeline begins the timeline of a new broadcast, if the stream wants a
+// summary. The stream must be locked.
+func (s *streamInfo) startTimeline(streamID string, startedAt time.Time) {
+	if !s.PostSummary {
+		s.Timeline = nil
+		return
+	}
+	s.Timeline = &streamTimeline{StreamID: streamID, StartedAt: startedAt.Unix()}
+	s.Timeline.record(s.Title, s.Category, startedAt)
+}
+
+// record notes the title and category, if they changed.
+func (t *streamTimeline) record(title string, category string, at time.Time) {
+	if n := len(t.Titles); n == 0 || t.Titles[n-1].Value != title {
+		t.Titles = append(t.Titles, timelineEntry{title, at.Unix()})
+	}
+	if n := len(t.Categories); n == 0 || t.Categories[n-1].Value != category {
+		t.Categories = append(t.Categories, timelineEntry{category, at.Unix()})
+	}
+}
+
+// sample adds a viewer count.
+func (t *streamTimeline) sample(viewers int) {
+	t.PeakViewers = max(t.PeakViewers, viewers)
+	t.ViewerTotal += int64(viewers)
+	t.ViewerCounts++
+}
+
+// categoryTimes adds up how long was spent in each category, in the order
+// they were first played.
+func (t *streamTimeline) categoryTimes() ([]string, map[string]time.Duration) {
+	var order []string
+	spent := make(map[string]time.Duration)
+	for i, entry := range t.Categories {
+		until := t.EndedAt
+		if i+1 < len(t.Categories) {
+			until = t.Categories[i+1].At
+		}
+		if _, ok := spent[entry.Value]; !ok {
+			order = append(order, entry.Value)
+		}
+		spent[entry.Value] += time.Duration(until-entry.At) * time.Second
+	}
+	return order, spent
+}
+
+// postSummary posts the recap of the stream's last broadcast to the Discord
+// channels it was announced in, or edits the recap already posted there.
+// Channels whose filter kept the broadcast from being announced get no recap
+// either. It runs on the stream's event queue.
+func (a *App) postSummary(channel *streamInfo) {
+	t := channel.Timeline
+	embed := &discordgo.MessageEmbed{
+		Author: &discordgo.MessageEmbedAuthor{
+			URL:  "https://www.twitch.tv/" + channel.StreamName,
+			Name: channel.displayName(),
+		},
+		Color: int(channel.HighlightColour),
+		Title: "Stream recap",
+		Fields: []*discordgo.MessageEmbedField{
+			{
+				Name:   "Duration",
+				Value:  formatDuration(time.Duration(t.EndedAt-t.StartedAt) * time.Second),
+				Inline: true,
+			},
+		},
+		Timestamp: time.Unix(t.StartedAt, 0).UTC().Format(time.RFC3339),
+	}
+	if t.ViewerCounts > 0 {
+		embed.Fields = append(embed.Fields,
+			&discordgo.MessageEmbedField{
+				Name:   "Peak viewers",
+				Value:  strconv.Itoa(t.PeakViewers),
+				Inline: true,
+			},
+			&discordgo.MessageEmbedField{
+				Name:   "Average viewers",
+				Value:  strconv.FormatInt(t.ViewerTotal/int64(t.ViewerCounts), 10),
+				Inline: true,
+			})
+	}
+
+	order, spent := t.categoryTimes()
+	var categories []string
+	for _, id := range order {
+		name := "N/A"
+		if id != "" {
+			if game, err := a.helix.Game(id); err == nil {
+				name = game.Name
+			} else {
+				log.Printf("Summarising %v without a game name: %v\n", channel.StreamName, err)
+			}
+		}
+		categories = append(categories, fmt.Sprintf("%v: %v", name, formatDuration(spent[id])))
+	}
+	embed.Fields = append(embed.Fields, summaryField("Categories", categories))
+
+	var titles []string
+	for _, entry := range t.Titles {
+		at := formatDuration(time.Duration(entry.At-t.StartedAt) * time.Second)
+		titles = append(titles, fmt.Sprintf("%v: %v", at, entry.Value))
+	}
+	embed.Fields = append(embed.Fields, summaryField("Titles", titles))
+
+	for _, target := range channel.Channels {
+		var messageID string
+		for _, posted := range t.Messages {
+			if posted.ChannelID == target.ChannelID {
+				messageID = posted.MessageID
+			}
+		}
+		if messageID == "" && target.MessageID == "" {
+			continue
+		}
+		if messageID != "" {
+			_, err := a.discord.ChannelMessageEditEmbed(target.ChannelID, messageID, embed)
+			if err != nil {
+				log.Printf("Could not update the recap of %v in <#%v>: %v\n", channel.StreamName, target.ChannelID, err)
+			}
+			continue
+		}
+		msg, err := a.discord.ChannelMessageSendEmbed(target.ChannelID, embed)
+		if err != nil {
+			log.Printf("Could not post the recap of %v in <#%v>: %v\n", channel.StreamName, target.ChannelID, err)
+			continue
+		}
+		t.Messages = append(t.Messages, discordChannel{ChannelID: target.ChannelID, MessageID: msg.ID})
+	}
+	a.saveStream(channel)
+}
+
+// summaryField lists lines in an embed field, dropping the ones that do not
+// fit in Discord's 1024 characters.
+func summaryField(name string, lines []string) *discordgo.MessageEmbedField {
+	const limit = 1024
+	var b strings.Builder
+	for i, line := range lines {
+		if b.Len()+len(line)+1 > limit-len("…") {
+			b.WriteString("…")
+			break
+		}
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(line)
+	}
+	if b.Len() == 0 {
+		b.WriteString("N/A")
+	}
+	return &discordgo.MessageEmbedField{Name: name, Value: b.String()}
+}
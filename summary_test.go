@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestSummaryFollowsFilters checks that the recap is only posted where the
+// broadcast was announced.
+func TestSummaryFollowsFilters(t *testing.T) {
+	fake := newFakeServices(t)
+	fake.addUser("1", "streamer1")
+	a := startTestApp(t, fake, []*streamInfo{{
+		StreamName:   "streamer1",
+		UserId:       "1",
+		ColourString: "0x9146FF",
+		Type:         twitchType,
+		PostSummary:  true,
+		Channels: []discordChannel{
+			{ChannelID: "201"},
+			{ChannelID: "202", Filter: &channelFilter{ExcludeGames: []string{"Art"}}},
+		},
+	}}, nil)
+
+	online := twitchEvent("stream.online", "1", "streamer1", map[string]any{
+		"id":         "stream-1",
+		"type":       "live",
+		"started_at": time.Now().UTC().Format(time.RFC3339),
+	})
+	if status := sendEventSub(t, a, "online-1", "notification", online); status != http.StatusNoContent {
+		t.Fatalf("stream.online returned %v", status)
+	}
+	eventually(t, "the announcement", func() bool { return len(fake.sentMessages()) == 1 })
+	if status := sendEventSub(t, a, "offline-1", "notification", twitchEvent("stream.offline", "1", "streamer1", nil)); status != http.StatusNoContent {
+		t.Fatalf("stream.offline returned %v", status)
+	}
+
+	eventually(t, "the recap", func() bool {
+		for _, m := range fake.sentMessages() {
+			if m.Method == http.MethodPost && len(m.Embeds) > 0 && m.Embeds[0].Title == "Stream recap" {
+				return true
+			}
+		}
+		return false
+	})
+	stream := a.findChannel("1", twitchType)
+	stream.withStream(func() {})
+	for _, m := range fake.sentMessages() {
+		if m.ChannelID != "201" {
+			t.Errorf("sent %v %q to the filtered channel %v", m.Method, m.Embeds[0].Title, m.ChannelID)
+		}
+	}
+}
+
+// TestViewerSamplesKeptInMemory checks that sampling viewers does not rewrite
+// the config, and that the samples are saved when the stream goes offline.
+func TestViewerSamplesKeptInMemory(t *testing.T) {
+	fake := newFakeServices(t)
+	fake.addUser("1", "streamer1")
+	a := startTestApp(t, fake, []*streamInfo{{
+		StreamName:   "streamer1",
+		UserId:       "1",
+		ColourString: "0x9146FF",
+		Type:         twitchType,
+		PostSummary:  true,
+		Channels:     []discordChannel{{ChannelID: "201"}},
+	}}, nil)
+
+	online := twitchEvent("stream.online", "1", "streamer1", map[string]any{
+		"id":         "stream-1",
+		"type":       "live",
+		"started_at": time.Now().UTC().Format(time.RFC3339),
+	})
+	if status := sendEventSub(t, a, "online-1", "notification", online); status != http.StatusNoContent {
+		t.Fatalf("stream.online returned %v", status)
+	}
+	stream := a.findChannel("1", twitchType)
+	eventually(t, "the stream to go live", func() bool {
+		var live bool
+		stream.withStream(func() { live = stream.IsLive && stream.Timeline != nil })
+		return live
+	})
+	before, _ := os.ReadFile(a.cfgPath)
+
+	fake.goLive("1", 42)
+	stream.withStream(func() { stream.nextRefresh = time.Now().Add(-time.Second) })
+	a.refreshLiveStreams()
+	eventually(t, "the viewer sample", func() bool {
+		var samples int
+		stream.withStream(func() { samples = stream.Timeline.ViewerCounts })
+		return samples == 1
+	})
+	if after, _ := os.ReadFile(a.cfgPath); !bytes.Equal(before, after) {
+		t.Error("sampling viewers rewrote the config")
+	}
+
+	if status := sendEventSub(t, a, "offline-1", "notification", twitchEvent("stream.offline", "1", "streamer1", nil)); status != http.StatusNoContent {
+		t.Fatalf("stream.offline returned %v", status)
+	}
+	eventually(t, "the samples to be saved", func() bool {
+		content, _ := os.ReadFile(a.cfgPath)
+		return bytes.Contains(content, []byte(`"peak_viewers":42`))
+	})
+}
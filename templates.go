@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// announcementData is what announcement templates are executed with, so a
+// template can use {{.Name}}, {{.Game}} and so on.
+type announcementData struct {
+	// Name is the broadcaster's display name and Login their Twitch login.
+	Name  string
+	Login string
+	// Title is the stream title, Game the category's name, or N/A, and
+	// GameID its Twitch ID.
+	Title  string
+	Game   string
+	GameID string
+	// Type is the kind of broadcast: live, playlist, watch_party, premiere
+	// or rerun.
+	Type string
+	// URL is the channel, PreviewURL a fresh 320x180 preview of the stream,
+	// ProfileImage the broadcaster's picture and BoxArt the category's 500x700
+	// box art.
+	URL          string
+	PreviewURL   string
+	ProfileImage string
+	BoxArt       string
+	// StartedAt is when the broadcast started, or zero if that is not known.
+	StartedAt time.Time
+	// Viewers is the viewer count at the last refresh, or zero before it.
+	Viewers int
+	// OfflineImage is the broadcaster's offline banner, if they have one.
+	OfflineImage string
+	// Ended is set when the announcement is edited at the end of the
+	// broadcast, along with how long it ran, if known, and the recording's
+	// URL, if there is one.
+	Ended    bool
+	Duration time.Duration
+	VOD      string
+}
+
+// sampleAnnouncement is used to check templates and as a placeholder where
+// nothing better is known.
+var sampleAnnouncement = announcementData{
+	Name:         "PaintBot",
+	Login:        "paintbot",
+	Title:        "Painting happy little trees",
+	Game:         "Art",
+	GameID:       "509660",
+	Type:         "live",
+	URL:          "https://www.twitch.tv/paintbot",
+	PreviewURL:   "https://static-cdn.jtvnw.net/previews-ttv/live_user_paintbot-320x180.png",
+	ProfileImage: "https://static-cdn.jtvnw.net/jtv_user_pictures/paintbot-profile_image-70x70.png",
+	BoxArt:       "https://static-cdn.jtvnw.net/ttv-boxart/509660-500x700.jpg",
+	StartedAt:    time.Date(2024, 1, 1, 18, 0, 0, 0, time.UTC),
+	Viewers:      42,
+}
+
+// announcementTemplate customises announcements, for a whole stream or for
+// one of its Discord channels. Every part is a text/template over
+// announcementData, and parts left empty keep the default. Colour must come
+// out as a colour like 0x9146FF; Fields, when given, replace the default
+// fields.
+type announcementTemplate struct {
+	Content     string          `json:"content,omitempty"`
+	Title       string          `json:"title,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Colour      string          `json:"colour,omitempty"`
+	Image       string          `json:"image,omitempty"`
+	Thumbnail   string          `json:"thumbnail,omitempty"`
+	Fields      []templateField `json:"fields,omitempty"`
+}
+
+type templateField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline,omitempty"`
+}
+
+// announcementFor gathers the template data for a Twitch stream. The stream
+// must be locked.
+func announcementFor(channel *streamInfo, user twitchUser, game twitchGame) announcementData {
+	data := announcementData{
+		Name:         channel.displayName(),
+		Login:        channel.StreamName,
+		Title:        channel.Title,
+		Game:         game.Name,
+		GameID:       channel.Category,
+		Type:         channel.BroadcastType,
+		URL:          "https://www.twitch.tv/" + channel.StreamName,
+		PreviewURL:   "https://static-cdn.jtvnw.net/previews-ttv/live_user_" + channel.StreamName + "-320x180.png" + "?r=" + time.Now().Format(time.RFC3339),
+		ProfileImage: strings.Replace(strings.Replace(user.ProfileImage, "{width}", "70", 1), "{height}", "70", 1),
+		BoxArt:       strings.Replace(strings.Replace(game.BoxArt, "{width}", "500", 1), "{height}", "700", 1),
+		Viewers:      channel.viewers,
+		OfflineImage: user.OfflineImage,
+	}
+	if data.Type == "" {
+		data.Type = "live"
+	}
+	if channel.StartedAt > 0 {
+		data.StartedAt = time.Unix(channel.StartedAt, 0).UTC()
+	}
+	return data
+}
+
+// announcement builds the message announcing channel in target: the default
+// layout, or the ended one when data.Ended is set, with the stream's template and then the channel's applied over it.
+// The stream must be locked.
+func (a *App) announcement(channel *streamInfo, target discordChannel, data announcementData) *discordgo.MessageSend {
+	embed := &discordgo.MessageEmbed{
+		Author: &discordgo.MessageEmbedAuthor{
+			URL:     data.URL,
+			Name:    data.Name,
+			IconURL: data.ProfileImage,
+		},
+		Color: int(channel.HighlightColour),
+		Fields: []*discordgo.MessageEmbedField{
+			{
+				Name:   "Game",
+				Value:  data.Game,
+				Inline: true,
+			},
+		},
+		Image: &discordgo.MessageEmbedImage{
+			URL: data.PreviewURL,
+		},
+		Thumbnail: &discordgo.MessageEmbedThumbnail{
+			URL: data.BoxArt,
+		},
+		Title:       data.Title,
+		URL:         data.URL,
+		Description: broadcastWording(channel.BroadcastType).live,
+	}
+	if embed.Description != "" {
+		embed.Description = fmt.Sprintf(embed.Description, data.Name)
+	}
+	if data.Ended {
+		endedLayout(embed, channel, data)
+	} else if channel.IsLive {
+		embed.Fields = append(embed.Fields, liveFields(channel)...)
+	}
+	message := &discordgo.MessageSend{
+		Content: channel.Description,
+		Embeds:  []*discordgo.MessageEmbed{embed},
+	}
+
+	for _, t := range []*announcementTemplate{channel.Template, target.Template} {
+		if err := t.apply(message, data); err != nil {
+			log.Printf("Could not use the template for %v in <#%v>: %v\n", channel.StreamName, target.ChannelID, err)
+		}
+	}
+	return message
+}
+
+// apply renders the template's parts into message. A nil template changes
+// nothing. On error, message is left as it was.
+func (t *announcementTemplate) apply(message *discordgo.MessageSend, data announcementData) error {
+	if t == nil {
+		return nil
+	}
+	var err error
+	render := func(part string, text string) string {
+		if err != nil {
+			return ""
+		}
+		var out string
+		out, err = renderTemplate(part, text, data)
+		return out
+	}
+
+	content, title, description := render("content", t.Content), render("title", t.Title), render("description", t.Description)
+	colour, image, thumbnail := render("colour", t.Colour), render("image", t.Image), render("thumbnail", t.Thumbnail)
+	var fields []*discordgo.MessageEmbedField
+	for _, f := range t.Fields {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   render("field name", f.Name),
+			Value:  render("field value", f.Value),
+			Inline: f.Inline,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	var colourValue int64
+	if t.Colour != "" {
+		if colourValue, err = parseColour(strings.TrimSpace(colour)); err != nil {
+			return fmt.Errorf("colour: %w", err)
+		}
+	}
+
+	embed := message.Embeds[0]
+	if t.Content != "" {
+		message.Content = content
+	}
+	if t.Title != "" {
+		embed.Title = title
+	}
+	if t.Description != "" {
+		embed.Description = description
+	}
+	if t.Colour != "" {
+		embed.Color = int(colourValue)
+	}
+	// Images that come out empty are left off.
+	if t.Image != "" {
+		embed.Image = nil
+		if image = strings.TrimSpace(image); image != "" {
+			embed.Image = &discordgo.MessageEmbedImage{URL: image}
+		}
+	}
+	if t.Thumbnail != "" {
+		embed.Thumbnail = nil
+		if thumbnail = strings.TrimSpace(thumbnail); thumbnail != "" {
+			embed.Thumbnail = &discordgo.MessageEmbedThumbnail{URL: thumbnail}
+		}
+	}
+	if len(t.Fields) > 0 {
+		embed.Fields = fields
+	}
+	return nil
+}
+
+// validate checks that every part of the template parses and runs, and that
+// Discord would accept what comes out.
+func (t *announcementTemplate) validate() error {
+	if len(t.Fields) > 25 {
+		return inputError("templates can have at most 25 fields")
+	}
+	message := &discordgo.MessageSend{Embeds: []*discordgo.MessageEmbed{{}}}
+	if err := t.apply(message, sampleAnnouncement); err != nil {
+		return inputError(err.Error())
+	}
+	for _, f := range message.Embeds[0].Fields {
+		if f.Name == "" || f.Value == "" {
+			return inputError("template fields need a name and a value")
+		}
+	}
+	return nil
+}
+
+func renderTemplate(part string, text string, data announcementData) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	tmpl, err := template.New(part).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("%v: %w", part, err)
+	}
+	var b strings.Builder
+	if err = tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("%v: %w", part, err)
+	}
+	return b.String(), nil
+}
+
+// normaliseTemplate checks t and returns it, or nil for a template that
+// changes nothing.
+func normaliseTemplate(t *announcementTemplate) (*announcementTemplate, error) {
+	if t == nil || t.Content+t.Title+t.Description+t.Colour+t.Image+t.Thumbnail == "" && len(t.Fields) == 0 {
+		return nil, nil
+	}
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// tokenValidationInterval is how often the app access token is checked with
+// Twitch, which requires apps to validate their tokens hourly.
+const tokenValidationInterval = time.Hour
+
+// appTokenSource hands out the app access token, fetching a new one when the
+// cached token has expired or Twitch has rejected it. Failing to fetch one is
+// returned as an error, so the next request simply tries again.
+type appTokenSource struct {
+	config *clientcredentials.Config
+	ctx    context.Context
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func (a *App) newAppTokenSource() *appTokenSource {
+	return &appTokenSource{
+		config: &clientcredentials.Config{
+			ClientID:     a.config.Secrets.TwitchClientID,
+			ClientSecret: a.config.Secrets.TwitchClientSecret,
+			TokenURL:     a.config.Endpoints.TwitchAuth + "/token",
+		},
+		ctx: context.WithValue(context.Background(), oauth2.HTTPClient, a.client),
+	}
+}
+
+func (s *appTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token.Valid() {
+		return s.token, nil
+	}
+	token, err := s.config.Token(s.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting a Twitch app access token: %w", err)
+	}
+	log.Println("Token Generated")
+	s.token = token
+	return token, nil
+}
+
+// invalidate drops accessToken, so that the next call to Token fetches a new
+// one. A token that has already been replaced is left alone.
+func (s *appTokenSource) invalidate(accessToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != nil && s.token.AccessToken == accessToken {
+		s.token = nil
+	}
+}
+
+// accessToken returns the current app access token for Helix requests.
+func (a *App) accessToken() (string, error) {
+	token, err := a.appToken.Token()
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// runTokenValidation validates the app access token every
+// tokenValidationInterval until the App is closed.
+func (a *App) runTokenValidation() {
+	ticker := time.NewTicker(tokenValidationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.validateToken(); err != nil {
+				log.Printf("Could not validate Twitch token: %v\n", err)
+			}
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// validateToken checks the app access token with Twitch, dropping it if it
+// is no longer valid so the next request gets a new one.
+func (a *App) validateToken() error {
+	token, err := a.accessToken()
+	if err != nil {
+		return err
+	}
+	req, _ := http.NewRequest("GET", a.config.Endpoints.TwitchAuth+"/validate", nil)
+	req.Header.Add("Authorization", "OAuth "+token)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		log.Println("Twitch token is no longer valid, getting a new one")
+		a.appToken.invalidate(token)
+		_, err = a.accessToken()
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("validating token returned %v", resp.Status)
+	}
+
+	var validation struct {
+		ExpiresIn int `json:"expires_in"`
+	}
+	json.NewDecoder(resp.Body).Decode(&validation)
+	log.Printf("Token validated, expires in %v\n", time.Duration(validation.ExpiresIn)*time.Second)
+	return nil
+}
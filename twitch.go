@@ -1,173 +1,155 @@
-package main
-
-import (
-	"bytes"
-	"encoding/json"
-	"io/ioutil"
-	"log"
-	"net/http"
-)
-
-func getTwitchUser(userId string) twitchUser {
-	var users twitchUserJSON
-
-	log.Println(userId)
-	req, _ := http.NewRequest("GET", "https://api.twitch.tv/helix/users?login="+userId, nil)
-	req.Header.Add("Client-ID", config.Secrets.TwitchClientID)
-	req.Header.Add("Authorization", "Bearer "+twitchToken.AccessToken)
-	req.Header.Add("Content-type", "application/json")
-
-	validateToken()
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
-	}
-	err = json.Unmarshal(body, &users)
-
-	if err != nil {
-		panic(err)
-	}
-
-	log.Println(users)
-	return users.Users[0]
-}
-
-func getTwitchChannel(userId string) twitchChannel {
-	var channels twitchChannelJSON
-
-	req, _ := http.NewRequest("GET", "https://api.twitch.tv/helix/channels?broadcaster_id="+userId, nil)
-	req.Header.Add("Client-ID", config.Secrets.TwitchClientID)
-	req.Header.Add("Authorization", "Bearer "+twitchToken.AccessToken)
-	req.Header.Add("Content-type", "application/json")
-
-	validateToken()
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
-	}
-	err = json.Unmarshal(body, &channels)
-
-	if err != nil {
-		panic(err)
-	}
-
-	log.Println(channels)
-	return channels.Channel[0]
-}
-
-func getTwitchGame(id string) *twitchGame {
-	var g twitchGameJSON
-
-	req, _ := http.NewRequest("GET", "https://api.twitch.tv/helix/games?id="+id, nil)
-	req.Header.Add("Client-ID", config.Secrets.TwitchClientID)
-	req.Header.Add("Authorization", "Bearer "+twitchToken.AccessToken)
-	req.Header.Add("Content-type", "application/json")
-
-	validateToken()
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
-	}
-
-	err = json.Unmarshal(body, &g)
-
-	if err != nil {
-		panic(err)
-	}
-
-	log.Println(g)
-	return &g.Games[0]
-}
-
-func getSubscriptions(status string) twitchSubscription {
-	var s twitchSubscription
-
-	req, _ := http.NewRequest("GET", "https://api.twitch.tv/helix/eventsub/subscriptions?status="+status, nil)
-	req.Header.Add("Client-ID", config.Secrets.TwitchClientID)
-	req.Header.Add("Authorization", "Bearer "+twitchToken.AccessToken)
-
-	validateToken()
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
-	}
-
-	err = json.Unmarshal(body, &s)
-
-	if err != nil {
-		panic(err)
-	}
-
-	return s
-}
-
-func deleteSubscription(subID string) {
-	req, _ := http.NewRequest("DELETE", "https://api.twitch.tv/helix/eventsub/subscriptions?id="+subID, nil)
-	req.Header.Add("Client-ID", config.Secrets.TwitchClientID)
-	req.Header.Add("Authorization", "Bearer "+twitchToken.AccessToken)
-
-	validateToken()
-	_, err := client.Do(req)
-	if err != nil {
-		panic(err)
-	}
-
-}
-
-func registerTwitchWebhook(client *http.Client, userId string, eventType string) {
-	conditions := make(map[string]string)
-	conditions["broadcaster_user_id"] = userId
-	createSubscription := &createSubscription{
-		EventType: eventType,
-		Version:   "1",
-		Condition: conditions,
-		Transport: transport{
-			Method:   "webhook",
-			Callback: "https://" + config.Secrets.BaseUrl + "/notify",
-			Secret:   "ThisIsASecret",
-		},
-	}
-	body, _ := json.Marshal(createSubscription)
-	//log.Printf("Registering createSubscription: %s\n", string(body))
-
-	validateToken()
-
-	req, _ := http.NewRequest("POST", "https://api.twitch.tv/helix/eventsub/subscriptions", bytes.NewBuffer(body))
-	req.Header.Add("Client-ID", config.Secrets.TwitchClientID)
-	req.Header.Add("Authorization", "Bearer "+twitchToken.AccessToken)
-	req.Header.Add("Content-type", "application/json")
-
-	log.Println("Registering webhook")
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Println("Panic at webhook POST")
-		panic(err)
-	}
-	defer resp.Body.Close()
-	// body, _ = ioutil.ReadAll(resp.Body)
-	log.Printf("Webhook returned: %s\n", resp.Status)
-}
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// twitchEventTypes are the EventSub subscriptions every Twitch stream needs.
+var twitchEventTypes = []string{"stream.online", "stream.offline", "channel.update"}
+
+// getSubscriptions lists our EventSub subscriptions with the given status, or
+// with any status when it is empty, following every page of results.
+func (a *App) getSubscriptions(status string) (twitchSubscription, error) {
+	var all twitchSubscription
+
+	query := url.Values{}
+	if status != "" {
+		query.Set("status", status)
+	}
+	for {
+		var s twitchSubscription
+		resp, err := a.subscriptionRequest("GET", a.config.Endpoints.TwitchAPI+"/eventsub/subscriptions?"+query.Encode(), nil)
+		if err != nil {
+			return all, err
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return all, err
+		}
+		if err = helixResponseError(resp, body); err != nil {
+			return all, fmt.Errorf("listing subscriptions: %w", err)
+		}
+
+		err = json.Unmarshal(body, &s)
+
+		if err != nil {
+			return all, err
+		}
+
+		all.Data = append(all.Data, s.Data...)
+		all.Total = s.Total
+		all.TotalCost = s.TotalCost
+		all.MaxTotalCost = s.MaxTotalCost
+		if s.Pagination.Cursor == "" || len(s.Data) == 0 {
+			a.recordSubscriptionCost(all)
+			return all, nil
+		}
+		query.Set("after", s.Pagination.Cursor)
+	}
+}
+
+func (a *App) deleteSubscription(subID string) error {
+	resp, err := a.subscriptionRequest("DELETE", a.config.Endpoints.TwitchAPI+"/eventsub/subscriptions?id="+url.QueryEscape(subID), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if err = helixResponseError(resp, body); err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("deleting subscription %v: %w", subID, err)
+	}
+	return nil
+}
+
+// registerTwitchSubscription subscribes to one event type for a broadcaster
+// over the configured EventSub transport.
+func (a *App) registerTwitchSubscription(userId string, eventType string) error {
+	conditions := make(map[string]string)
+	conditions["broadcaster_user_id"] = userId
+	transport, err := a.eventSubTransport()
+	if err != nil {
+		return err
+	}
+	if err = a.checkSubscriptionBudget(userId, eventType); err != nil {
+		a.budgetExhausted(err)
+		return err
+	}
+	createSubscription := &createSubscription{
+		EventType: eventType,
+		Version:   "1",
+		Condition: conditions,
+		Transport: transport,
+	}
+	body, _ := json.Marshal(createSubscription)
+	//log.Printf("Registering createSubscription: %s\n", string(body))
+
+	log.Printf("Registering %v subscription\n", transport.Method)
+	resp, err := a.subscriptionRequest("POST", a.config.Endpoints.TwitchAPI+"/eventsub/subscriptions", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	log.Printf("Subscription returned: %s\n", resp.Status)
+	if resp.StatusCode == http.StatusConflict {
+		// Already subscribed, for example by the reconciler.
+		return nil
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		// Twitch refuses subscriptions past max_total_cost with a 429.
+		err = fmt.Errorf("%w: registering %v for %v returned %v: %s", errSubscriptionBudget, eventType, userId, resp.Status, body)
+		a.budgetExhausted(err)
+		return err
+	}
+	if err = helixResponseError(resp, body); err != nil {
+		return fmt.Errorf("registering %v for %v: %w", eventType, userId, err)
+	}
+	var created twitchSubscription
+	if json.Unmarshal(body, &created) == nil {
+		a.recordSubscriptionCost(created)
+	}
+	a.budgetRecovered()
+	return nil
+}
+
+// eventSubTransport is where new subscriptions deliver their events: our
+// webhook callback, or the current WebSocket session.
+func (a *App) eventSubTransport() (transport, error) {
+	if a.config.EventSubTransport != websocketTransport {
+		return transport{
+			Method:   webhookTransport,
+			Callback: a.webhookCallback(),
+			Secret:   a.config.Secrets.EventSubSecret,
+		}, nil
+	}
+	sessionID := a.eventSubSession()
+	if sessionID == "" {
+		return transport{}, errNoEventSubSession
+	}
+	return transport{Method: websocketTransport, SessionID: sessionID}, nil
+}
+
+// webhookCallback is the URL our webhook subscriptions deliver to.
+func (a *App) webhookCallback() string {
+	return "https://" + a.config.Secrets.BaseUrl + "/notify"
+}
+
+// subscribeTwitchStream registers every event type the bot listens to for the
+// given stream.
+func (a *App) subscribeTwitchStream(channel *streamInfo) error {
+	for _, eventType := range twitchEventTypes {
+		if err := a.registerTwitchSubscription(channel.UserId, eventType); err != nil {
+			return err
+		}
+	}
+	channel.Unsubscribed = false
+	return nil
+}
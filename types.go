@@ -1,129 +1,280 @@
-package main
-
-import "net/http"
-
-type createSubscription struct {
-	EventType string            `json:"type"`
-	Version   string            `json:"version"`
-	Condition map[string]string `json:"condition"`
-	Transport transport         `json:"transport"`
-}
-type transport struct {
-	Method   string `json:"method"`
-	Callback string `json:"callback"`
-	Secret   string `json:"secret"`
-}
-
-type twitchUser struct {
-	ID              string `json:"id"`
-	Login           string `json:"login"`
-	DisplayName     string `json:"display_name"`
-	UserType        string `json:"type"`
-	BroadcasterType string `json:"broadcaster_type"`
-	Description     string `json:"description"`
-	ProfileImage    string `json:"profile_image_url"`
-	OfflineImage    string `json:"offline_image_url"`
-	ViewCount       int    `json:"view_count"`
-	Email           string `json:"email"`
-}
-type twitchUserJSON struct {
-	Users []twitchUser `json:"data"`
-}
-
-type twitchChannel struct {
-	ID          string `json:"broadcaster_id"`
-	Login       string `json:"broadcaster_login"`
-	DisplayName string `json:"broadcaster_name"`
-	Language    string `json:"broadcaster_language"`
-	GameID      string `json:"game_id"`
-	GameName    string `json:"game_name"`
-	Title       string `json:"title"`
-	Delay       int    `json:"delay"`
-}
-type twitchChannelJSON struct {
-	Channel []twitchChannel `json:"data"`
-}
-
-type subscriptionInfo struct {
-	ID        string            `json:"id"`
-	Status    string            `json:"status"`
-	Type      string            `json:"type"`
-	Version   string            `json:"version"`
-	Cost      int               `json:"cost"`
-	Condition map[string]string `json:"condition"`
-	Transport map[string]string `json:"transport"`
-	CreatedAt string            `json:"created_at"`
-}
-type notification struct {
-	SubscriptionInfo subscriptionInfo `json:"subscription"`
-	Event            map[string]any   `json:"event"`
-}
-type callbackVerification struct {
-	SubscriptionInfo subscriptionInfo `json:"subscription"`
-	Challenge        string           `json:"challenge"`
-}
-
-type twitchGame struct {
-	ID     string `json:"id"`
-	Name   string `json:"name"`
-	BoxArt string `json:"box_art_url"`
-}
-type twitchGameJSON struct {
-	Games []twitchGame `json:"data"`
-}
-
-type twitchSubscription struct {
-	Total        int                `json:"total"`
-	Data         []subscriptionInfo `json:"data"`
-	TotalCost    int                `json:"total_cost"`
-	MaxTotalCost int                `json:"max_total_cost"`
-}
-
-type discordChannel struct {
-	ChannelID string `json:"id"`
-	MessageID string `json:"message_id"`
-}
-
-type streamInfo struct {
-	StreamName      string           `json:"stream_name"`
-	UserId          string           `json:"twitch_user_id"`
-	Channels        []discordChannel `json:"discord_channel_ids"`
-	ColourString    string           `json:"colour"`
-	HighlightColour int64            `json:"highlight_colour"`
-	CurrentStreamID string           `json:"current_stream"`
-	Description     string           `json:"description"`
-	IsLive          bool             `json:"is_live"`
-	Category        string           `json:"category"`
-	Title           string           `json:"title"`
-	OfflineTime     int64            `json:"offline_time"`
-	LastOffline     int64            `json:"last_offline"`
-	Type            int              `json:"type"`
-	VideoIds        []string         `json:"video_ids"`
-	DisableOffline  bool             `json:"disable_offline"`
-}
-
-type secrets struct {
-	BotToken           string `json:"bot_token"`
-	TwitchClientID     string `json:"twitch_client_id"`
-	TwitchClientSecret string `json:"twitch_client_secret"`
-	BaseUrl            string `json:"url"`
-}
-
-type cofiguration struct {
-	Secrets secrets       `json:"secrets"`
-	Streams []*streamInfo `json:"streams"`
-}
-
-type hub struct {
-	Mode         string `json:"hub.mode"`
-	Topic        string `json:"hub.topic"`
-	Callback     string `json:"hub.callback"`
-	LeaseSeconds int    `json:"hub.lease_seconds"`
-}
-
-type Handler func(http.ResponseWriter, *http.Request) error
-
-const (
-	twitchType  = 1
-	youtubeType = 2
-)
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+type createSubscription struct {
+	EventType string            `json:"type"`
+	Version   string            `json:"version"`
+	Condition map[string]string `json:"condition"`
+	Transport transport         `json:"transport"`
+}
+type transport struct {
+	Method    string `json:"method"`
+	Callback  string `json:"callback,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+}
+
+type twitchUser struct {
+	ID              string `json:"id"`
+	Login           string `json:"login"`
+	DisplayName     string `json:"display_name"`
+	UserType        string `json:"type"`
+	BroadcasterType string `json:"broadcaster_type"`
+	Description     string `json:"description"`
+	ProfileImage    string `json:"profile_image_url"`
+	OfflineImage    string `json:"offline_image_url"`
+	ViewCount       int    `json:"view_count"`
+	Email           string `json:"email"`
+}
+
+type twitchChannel struct {
+	ID          string `json:"broadcaster_id"`
+	Login       string `json:"broadcaster_login"`
+	DisplayName string `json:"broadcaster_name"`
+	Language    string `json:"broadcaster_language"`
+	GameID      string `json:"game_id"`
+	GameName    string `json:"game_name"`
+	Title       string `json:"title"`
+	Delay       int    `json:"delay"`
+}
+
+type subscriptionInfo struct {
+	ID        string            `json:"id"`
+	Status    string            `json:"status"`
+	Type      string            `json:"type"`
+	Version   string            `json:"version"`
+	Cost      int               `json:"cost"`
+	Condition map[string]string `json:"condition"`
+	Transport map[string]string `json:"transport"`
+	CreatedAt string            `json:"created_at"`
+}
+type notification struct {
+	SubscriptionInfo subscriptionInfo `json:"subscription"`
+	Event            map[string]any   `json:"event"`
+}
+type callbackVerification struct {
+	SubscriptionInfo subscriptionInfo `json:"subscription"`
+	Challenge        string           `json:"challenge"`
+}
+
+type twitchGame struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	BoxArt string `json:"box_art_url"`
+}
+
+type twitchStream struct {
+	ID           string `json:"id"`
+	UserID       string `json:"user_id"`
+	UserLogin    string `json:"user_login"`
+	UserName     string `json:"user_name"`
+	GameID       string `json:"game_id"`
+	Type         string `json:"type"`
+	Title        string `json:"title"`
+	ViewerCount  int    `json:"viewer_count"`
+	StartedAt    string `json:"started_at"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+type twitchVideo struct {
+	ID        string `json:"id"`
+	StreamID  string `json:"stream_id"`
+	UserID    string `json:"user_id"`
+	Title     string `json:"title"`
+	URL       string `json:"url"`
+	Type      string `json:"type"`
+	Duration  string `json:"duration"`
+	CreatedAt string `json:"created_at"`
+}
+
+type twitchSubscription struct {
+	Total        int                `json:"total"`
+	Data         []subscriptionInfo `json:"data"`
+	TotalCost    int                `json:"total_cost"`
+	MaxTotalCost int                `json:"max_total_cost"`
+	Pagination   struct {
+		Cursor string `json:"cursor,omitempty"`
+	} `json:"pagination"`
+}
+
+type discordChannel struct {
+	ChannelID string                `json:"id"`
+	MessageID string                `json:"message_id"`
+	Filter    *channelFilter        `json:"filter,omitempty"`
+	Template  *announcementTemplate `json:"template,omitempty"`
+}
+
+type streamInfo struct {
+	ID              int64            `json:"id,omitempty"`
+	StreamName      string           `json:"stream_name"`
+	DisplayName     string           `json:"display_name,omitempty"`
+	UserId          string           `json:"twitch_user_id"`
+	Channels        []discordChannel `json:"discord_channel_ids"`
+	ColourString    string           `json:"colour"`
+	HighlightColour int64            `json:"highlight_colour"`
+	CurrentStreamID string           `json:"current_stream"`
+	Description     string           `json:"description"`
+	IsLive          bool             `json:"is_live"`
+	StartedAt       int64            `json:"started_at,omitempty"`
+	Category        string           `json:"category"`
+	Title           string           `json:"title"`
+	ProfileImage    string           `json:"profile_image,omitempty"`
+	OfflineTime     int64            `json:"offline_time"`
+	LastOffline     int64            `json:"last_offline"`
+	Type            int              `json:"type"`
+	VideoIds        []string         `json:"video_ids"`
+	DisableOffline  bool             `json:"disable_offline"`
+	Unsubscribed    bool             `json:"unsubscribed"`
+
+	// RefreshInterval is how often, in seconds, the announcement of a live
+	// stream is updated with its viewer count, uptime and thumbnail. Zero
+	// turns the refresh off.
+	RefreshInterval int64 `json:"refresh_interval,omitempty"`
+
+	// PostSummary posts a recap when a broadcast ends, from the Timeline
+	// recorded while it was live.
+	PostSummary bool            `json:"post_summary,omitempty"`
+	Timeline    *streamTimeline `json:"timeline,omitempty"`
+
+	// AnnounceTypes are the kinds of broadcast, such as "live" or "rerun",
+	// that are announced. When empty, all of them are. BroadcastType is the
+	// kind of the current or last broadcast.
+	AnnounceTypes []string `json:"announce_types,omitempty"`
+	BroadcastType string   `json:"broadcast_type,omitempty"`
+
+	// Template customises the stream's announcements in every channel.
+	Template *announcementTemplate `json:"template,omitempty"`
+
+	// lookupName and lookupID are copies of StreamName and UserId for
+	// findChannel, guarded by the App's streamsMu rather than mu.
+	lookupName string
+	lookupID   string
+
+	// viewers and nextRefresh are kept by the live refresh while the stream
+	// is live.
+	viewers     int
+	nextRefresh time.Time
+
+	mu      sync.Mutex
+	queueMu sync.Mutex
+	events  chan func()
+	stopped bool
+}
+
+type secrets struct {
+	BotToken           string `json:"bot_token"`
+	TwitchClientID     string `json:"twitch_client_id"`
+	TwitchClientSecret string `json:"twitch_client_secret"`
+	BaseUrl            string `json:"url"`
+
+	EventSubSecret         string `json:"eventsub_secret"`
+	PreviousEventSubSecret string `json:"previous_eventsub_secret,omitempty"`
+	// EventSubSecretCreated is when EventSubSecret was generated. Webhook
+	// subscriptions created before it were made with the previous secret.
+	EventSubSecretCreated string `json:"eventsub_secret_created,omitempty"`
+
+	// TwitchUserToken and TwitchRefreshToken are a user access token for the
+	// Twitch application, which EventSub requires for WebSocket
+	// subscriptions. The refresh token is used to renew it when it expires.
+	TwitchUserToken    string `json:"twitch_user_token,omitempty"`
+	TwitchRefreshToken string `json:"twitch_refresh_token,omitempty"`
+
+	// DiscordClientID and DiscordClientSecret are the OAuth2 credentials of
+	// the Discord application, used to log in to the dashboard.
+	DiscordClientID     string `json:"discord_client_id,omitempty"`
+	DiscordClientSecret string `json:"discord_client_secret,omitempty"`
+	SessionSecret       string `json:"session_secret,omitempty"`
+}
+
+type cofiguration struct {
+	Secrets secrets       `json:"secrets"`
+	Streams []*streamInfo `json:"streams,omitempty"`
+
+	// Storage selects where streams are kept: "sqlite" (the default) or
+	// "json" to keep them in this file.
+	Storage  string `json:"storage,omitempty"`
+	Database string `json:"database,omitempty"`
+
+	// ConfigBackups is how many previous versions of this file are kept as
+	// cfg.txt.1, cfg.txt.2 and so on.
+	ConfigBackups int `json:"config_backups"`
+
+	// ListenAddr is the address the webhook server listens on.
+	ListenAddr string    `json:"listen_addr,omitempty"`
+	Endpoints  endpoints `json:"endpoints"`
+
+	// MessageRetention is how long, in seconds, EventSub message IDs are
+	// remembered for deduplication. It is never less than the ten minutes
+	// a signed delivery is accepted for.
+	MessageRetention int64 `json:"message_retention"`
+
+	// AdminChannelID is the Discord channel that problems needing a human,
+	// such as revoked subscriptions, are reported to.
+	AdminChannelID string `json:"admin_channel_id"`
+
+	// DashboardGuildID limits dashboard logins to managers of one guild. When
+	// empty, managers of any guild the bot is in can log in. Either way they
+	// only see the streams announced in the guilds they manage.
+	DashboardGuildID string `json:"dashboard_guild_id,omitempty"`
+
+	// EventSubTransport is how Twitch delivers events: "webhook" (the
+	// default) to BaseUrl, or "websocket" over a connection the bot opens,
+	// which needs no public callback but does need a user access token.
+	EventSubTransport string `json:"eventsub_transport,omitempty"`
+
+	// SubscriptionSync is how often, in seconds, EventSub subscriptions are
+	// checked against the tracked streams and repaired.
+	SubscriptionSync int64 `json:"subscription_sync_interval"`
+
+	// CostReserve is how much of the EventSub cost budget only stream.online
+	// subscriptions may use, so announcements keep working near the cap. It
+	// is capped at a tenth of Twitch's max_total_cost. A negative value
+	// disables the reserve.
+	CostReserve int `json:"subscription_cost_reserve"`
+
+	// VODLookupWindow is how long, in seconds, after a stream ends the bot
+	// keeps looking for its VOD to link from the announcement. A negative
+	// value turns the lookup off.
+	VODLookupWindow int64 `json:"vod_lookup_window"`
+
+	// APIKeys may call the REST API. Only a hash of each key is kept; new
+	// keys are made with -add-api-key.
+	APIKeys []apiKey `json:"api_keys,omitempty"`
+}
+
+// apiKey is one bearer token accepted by the REST API.
+type apiKey struct {
+	Name string `json:"name"`
+	Hash string `json:"sha256"`
+}
+
+// endpoints are the base URLs of the services the bot talks to. They default
+// to the real services and can be pointed elsewhere, such as at the Twitch
+// CLI's mock API.
+type endpoints struct {
+	TwitchAPI  string `json:"twitch_api,omitempty"`
+	TwitchAuth string `json:"twitch_auth,omitempty"`
+	YouTubeHub string `json:"youtube_hub,omitempty"`
+	Discord    string `json:"discord,omitempty"`
+
+	TwitchEventSubWS string `json:"twitch_eventsub_ws,omitempty"`
+}
+
+type hub struct {
+	Mode         string `json:"hub.mode"`
+	Topic        string `json:"hub.topic"`
+	Callback     string `json:"hub.callback"`
+	LeaseSeconds int    `json:"hub.lease_seconds"`
+}
+
+type Handler func(http.ResponseWriter, *http.Request) error
+
+const (
+	twitchType  = 1
+	youtubeType = 2
+)
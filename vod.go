@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// defaultVODLookupWindow is how long, in seconds, the VOD of an ended
+	// stream is looked for when the config does not say.
+	defaultVODLookupWindow int64 = 1800
+
+	// vodLookupInterval is how long to wait between looking for a VOD.
+	vodLookupInterval = time.Minute
+)
+
+// findVOD looks for the archive of the broadcast streamID until it turns up
+// or VODLookupWindow runs out, then adds a link to it to the ended
+// announcement. It runs in its own goroutine; the announcement is edited on
+// the stream's event queue, and left alone if another broadcast has started
+// since.
+func (a *App) findVOD(channel *streamInfo, streamID string) {
+	var userID, name string
+	channel.withStream(func() {
+		userID, name = channel.UserId, channel.StreamName
+	})
+	deadline := time.Now().Add(time.Duration(a.config.VODLookupWindow) * time.Second)
+	for {
+		videos, err := a.helix.Archives(userID)
+		if err != nil {
+			log.Println(err)
+		}
+		for _, video := range videos {
+			if video.StreamID != streamID {
+				continue
+			}
+			channel.dispatch(func() {
+				if channel.IsLive || channel.CurrentStreamID != streamID {
+					return
+				}
+				a.endNotification(channel, video.URL)
+			})
+			return
+		}
+
+		if time.Now().Add(vodLookupInterval).After(deadline) {
+			log.Printf("No VOD found for %v's broadcast %v\n", name, streamID)
+			return
+		}
+		select {
+		case <-time.After(vodLookupInterval):
+		case <-a.done:
+			return
+		}
+	}
+}
@@ -1,98 +1,220 @@
-package main
-
-import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"time"
-
-	"github.com/mmcdole/gofeed/atom"
-)
-
-func setupYouTubeNotification(channel *streamInfo) {
-	hub := &hub{
-		Callback:     "https://" + config.Secrets.BaseUrl + "/youtube",
-		Mode:         "subscribe",
-		Topic:        "https://www.youtube.com/xml/feeds/videos.xml?channel_id=" + channel.UserId,
-		LeaseSeconds: 604800,
-	}
-	body, _ := json.Marshal(hub)
-	//log.Printf("Registering hub: %s", string(body))
-
-	req, _ := http.NewRequest("POST", "https://pubsubhubbub.appspot.com/subscribe?hub.verify=async&hub.callback="+hub.Callback+"&hub.mode="+hub.Mode+"&hub.topic="+hub.Topic+"&hub.lease_seconds="+fmt.Sprint(hub.LeaseSeconds), bytes.NewBuffer(body))
-	req.Header.Add("Content-type", "application/json")
-
-	log.Println("Registering webhook for channel: " + channel.UserId)
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Println("Panic at webhook POST")
-		panic(err)
-	}
-	defer resp.Body.Close()
-
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	log.Println(string(b))
-	go renewWebhook(channel)
-}
-
-func renewWebhook(channel *streamInfo) {
-	time.Sleep(144 * time.Hour)
-	setupYouTubeNotification(channel)
-}
-
-func handleYoutubeNotification(w http.ResponseWriter, r *http.Request) (err error) {
-	log.Printf("Handling notification: %v\n", r.URL)
-	challenge := r.URL.Query().Get("hub.challenge")
-
-	if challenge != "" {
-		log.Printf("Challenge is: %v\n", challenge)
-		w.Write([]byte(challenge))
-	} else {
-		w.WriteHeader(http.StatusNoContent)
-		log.Printf("Responded to webhook\n")
-		defer r.Body.Close()
-
-		atomParser := atom.Parser{}
-		feed, atomError := atomParser.Parse(r.Body)
-		if err != nil {
-			log.Println(atomError)
-			return
-		}
-		log.Println(feed)
-
-		channel := findChannel(feed.Entries[0].Extensions["yt"]["channelId"][0].Value, youtubeType)
-		if channel == nil {
-			return
-		}
-
-		if feed.Entries[0].PublishedParsed.Before(time.Now().UTC().Add(-24 * time.Hour)) {
-			log.Printf("Video is older than 24 hours\n")
-			return
-		}
-
-		for _, video := range channel.VideoIds {
-			if video == feed.Entries[0].Extensions["yt"]["videoId"][0].Value {
-				log.Printf("Video %v has already been posted\n", video)
-				return
-			}
-		}
-
-		discord := createDiscordSession()
-		defer discord.Close()
-
-		for _, entry := range feed.Entries {
-			for _, discordChannel := range channel.Channels {
-				discord.ChannelMessageSend(discordChannel.ChannelID, entry.Authors[0].Name+" has posted a new video: "+entry.Links[0].Href)
-			}
-			channel.VideoIds = append(channel.VideoIds, feed.Entries[0].Extensions["yt"]["videoId"][0].Value)
-		}
-		writeConfig()
-	}
-	return
-}
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/mmcdole/gofeed/atom"
+)
+
+// youtubeLease is what we know about our WebSub subscription to one channel's
+// uploads, as requested from and then confirmed by the hub.
+type youtubeLease struct {
+	ChannelID    string     `json:"channel_id"`
+	Mode         string     `json:"mode"`
+	RequestedAt  time.Time  `json:"requested_at"`
+	RequestError string     `json:"request_error,omitempty"`
+	VerifiedAt   *time.Time `json:"verified_at,omitempty"`
+	LeaseSeconds int64      `json:"lease_seconds,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+}
+
+func (a *App) setupYouTubeNotification(channel *streamInfo) {
+	if err := a.youtubeHubRequest(channel.UserId, "subscribe"); err != nil {
+		log.Printf("Could not subscribe to %v: %v\n", channel.UserId, err)
+	}
+	go a.renewWebhook(channel)
+}
+
+// youtubeHubRequest asks the hub to subscribe our callback to, or unsubscribe
+// it from, a channel's uploads feed.
+func (a *App) youtubeHubRequest(channelID string, mode string) error {
+	hub := &hub{
+		Callback:     "https://" + a.config.Secrets.BaseUrl + "/youtube",
+		Mode:         mode,
+		Topic:        "https://www.youtube.com/xml/feeds/videos.xml?channel_id=" + channelID,
+		LeaseSeconds: 604800,
+	}
+	body, _ := json.Marshal(hub)
+	//log.Printf("Registering hub: %s", string(body))
+
+	req, _ := http.NewRequest("POST", a.config.Endpoints.YouTubeHub+"?hub.verify=async&hub.callback="+hub.Callback+"&hub.mode="+hub.Mode+"&hub.topic="+hub.Topic+"&hub.lease_seconds="+fmt.Sprint(hub.LeaseSeconds), bytes.NewBuffer(body))
+	req.Header.Add("Content-type", "application/json")
+
+	log.Printf("Sending %v request for channel: %v\n", mode, channelID)
+	err := a.doYoutubeHubRequest(req)
+	a.leasesMu.Lock()
+	lease := &youtubeLease{ChannelID: channelID, Mode: mode, RequestedAt: time.Now().UTC()}
+	if err != nil {
+		lease.RequestError = err.Error()
+	}
+	a.youtubeLeases[channelID] = lease
+	a.leasesMu.Unlock()
+	return err
+}
+
+func (a *App) doYoutubeHubRequest(req *http.Request) error {
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	log.Println(string(b))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("hub returned %v: %s", resp.Status, b)
+	}
+	return nil
+}
+
+func (a *App) renewWebhook(channel *streamInfo) {
+	select {
+	case <-time.After(144 * time.Hour):
+	case <-a.done:
+		return
+	}
+	if !a.tracking(channel) {
+		return
+	}
+	channel.withStream(func() {
+		a.setupYouTubeNotification(channel)
+	})
+}
+
+func (a *App) handleYoutubeNotification(w http.ResponseWriter, r *http.Request) (err error) {
+	log.Printf("Handling notification: %v\n", r.URL)
+	challenge := r.URL.Query().Get("hub.challenge")
+
+	if challenge != "" {
+		log.Printf("Challenge is: %v\n", challenge)
+		a.verifyYoutubeLease(r.URL.Query())
+		w.Write([]byte(challenge))
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+		log.Printf("Responded to webhook\n")
+		defer r.Body.Close()
+
+		atomParser := atom.Parser{}
+		feed, atomError := atomParser.Parse(r.Body)
+		if atomError != nil {
+			log.Println(atomError)
+			return
+		}
+		log.Println(feed)
+		if len(feed.Entries) == 0 {
+			return
+		}
+
+		channelID := youtubeExtension(feed.Entries[0], "channelId")
+		if channelID == "" {
+			log.Printf("Feed entry has no channel ID, ignoring it\n")
+			return
+		}
+		channel := a.findChannel(channelID, youtubeType)
+		if channel == nil {
+			return
+		}
+
+		if published := feed.Entries[0].PublishedParsed; published != nil && published.Before(time.Now().UTC().Add(-24*time.Hour)) {
+			log.Printf("Video is older than 24 hours\n")
+			return
+		}
+
+		channel.dispatch(func() {
+			a.postYoutubeVideos(channel, feed)
+		})
+	}
+	return
+}
+
+// verifyYoutubeLease records the hub confirming a subscribe or unsubscribe
+// request, along with how long a subscription lasts.
+func (a *App) verifyYoutubeLease(query url.Values) {
+	topic, err := url.Parse(query.Get("hub.topic"))
+	if err != nil {
+		return
+	}
+	channelID := topic.Query().Get("channel_id")
+
+	a.leasesMu.Lock()
+	defer a.leasesMu.Unlock()
+	lease := a.youtubeLeases[channelID]
+	if lease == nil {
+		lease = &youtubeLease{ChannelID: channelID}
+		a.youtubeLeases[channelID] = lease
+	}
+	now := time.Now().UTC()
+	lease.Mode = query.Get("hub.mode")
+	lease.VerifiedAt = &now
+	lease.LeaseSeconds, _ = strconv.ParseInt(query.Get("hub.lease_seconds"), 10, 64)
+	lease.ExpiresAt = nil
+	if lease.LeaseSeconds > 0 {
+		expires := now.Add(time.Duration(lease.LeaseSeconds) * time.Second)
+		lease.ExpiresAt = &expires
+	}
+}
+
+// youtubeLeaseState returns a copy of every lease we have asked the hub for.
+func (a *App) youtubeLeaseState() []youtubeLease {
+	a.leasesMu.Lock()
+	defer a.leasesMu.Unlock()
+	leases := make([]youtubeLease, 0, len(a.youtubeLeases))
+	for _, lease := range a.youtubeLeases {
+		leases = append(leases, *lease)
+	}
+	return leases
+}
+
+// postYoutubeVideos announces the videos in feed that have not been posted yet.
+// It runs on the stream's event queue with the stream locked.
+func (a *App) postYoutubeVideos(channel *streamInfo, feed *atom.Feed) {
+	for _, entry := range feed.Entries {
+		videoID := youtubeExtension(entry, "videoId")
+		if videoID == "" {
+			log.Printf("Feed entry %q has no video ID, ignoring it\n", entry.Title)
+			continue
+		}
+		if slices.Contains(channel.VideoIds, videoID) {
+			log.Printf("Video %v has already been posted\n", videoID)
+			continue
+		}
+
+		author := channel.displayName()
+		if len(entry.Authors) > 0 && entry.Authors[0].Name != "" {
+			author = entry.Authors[0].Name
+		}
+		link := "https://www.youtube.com/watch?v=" + videoID
+		if len(entry.Links) > 0 && entry.Links[0].Href != "" {
+			link = entry.Links[0].Href
+		}
+		for _, discordChannel := range channel.Channels {
+			a.discord.ChannelMessageSend(discordChannel.ChannelID, author+" has posted a new video: "+link)
+		}
+		channel.VideoIds = append(channel.VideoIds, videoID)
+		if err := a.store.AddVideoID(channel, videoID); err != nil {
+			log.Printf("Could not save video ID: %v\n", err)
+		}
+	}
+}
+
+// youtubeExtension returns the value of one of the yt: elements of a feed
+// entry, such as its videoId, or "" if the entry does not have it.
+func youtubeExtension(entry *atom.Entry, name string) string {
+	values := entry.Extensions["yt"][name]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0].Value
+}
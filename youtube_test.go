@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testYoutubeChannel = "UC0123456789abcdefghijkl"
+
+func postYoutubeFeed(t *testing.T, a *App, feed string) {
+	t.Helper()
+	resp, err := http.Post("http://"+a.Addr().String()+"/youtube", "application/atom+xml", strings.NewReader(feed))
+	if err != nil {
+		t.Fatalf("posting the feed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("posting the feed returned %v", resp.Status)
+	}
+}
+
+// TestYoutubeFeed checks that every entry of a feed is announced under its
+// own video ID, and that entries missing parts are skipped or filled in
+// rather than crashing the handler.
+func TestYoutubeFeed(t *testing.T) {
+	fake := newFakeServices(t)
+	a := startTestApp(t, fake, []*streamInfo{{
+		StreamName: "Painter",
+		UserId:     testYoutubeChannel,
+		Type:       youtubeType,
+		Channels:   []discordChannel{{ChannelID: "201"}},
+	}}, nil)
+	stream := a.findChannel(testYoutubeChannel, youtubeType)
+
+	postYoutubeFeed(t, a, `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns:yt="http://www.youtube.com/xml/schemas/2015" xmlns="http://www.w3.org/2005/Atom">
+  <entry>
+    <title>No video ID</title>
+    <yt:channelId>`+testYoutubeChannel+`</yt:channelId>
+  </entry>
+  <entry>
+    <title>No author or link</title>
+    <yt:videoId>video-1</yt:videoId>
+    <yt:channelId>`+testYoutubeChannel+`</yt:channelId>
+  </entry>
+  <entry>
+    <title>Second</title>
+    <yt:videoId>video-2</yt:videoId>
+    <yt:channelId>`+testYoutubeChannel+`</yt:channelId>
+    <link rel="alternate" href="https://www.youtube.com/watch?v=video-2"/>
+    <author><name>Painter Channel</name></author>
+  </entry>
+</feed>`)
+	eventually(t, "both videos", func() bool { return len(fake.sentMessages()) == 2 })
+	var ids []string
+	stream.withStream(func() { ids = slices.Clone(stream.VideoIds) })
+	if !slices.Equal(ids, []string{"video-1", "video-2"}) {
+		t.Errorf("video IDs = %v, want video-1 and video-2", ids)
+	}
+	messages := fake.sentMessages()
+	if want := "Painter has posted a new video: https://www.youtube.com/watch?v=video-1"; messages[0].Content != want {
+		t.Errorf("first message = %q, want %q", messages[0].Content, want)
+	}
+	if want := "Painter Channel has posted a new video: https://www.youtube.com/watch?v=video-2"; messages[1].Content != want {
+		t.Errorf("second message = %q, want %q", messages[1].Content, want)
+	}
+
+	// A feed without a channel ID is ignored, and one repeating a video is not
+	// announced again.
+	postYoutubeFeed(t, a, `<feed xmlns="http://www.w3.org/2005/Atom"><entry><title>Nothing</title></entry></feed>`)
+	postYoutubeFeed(t, a, `<feed xmlns:yt="http://www.youtube.com/xml/schemas/2015" xmlns="http://www.w3.org/2005/Atom">
+  <entry><yt:videoId>video-2</yt:videoId><yt:channelId>`+testYoutubeChannel+`</yt:channelId></entry>
+</feed>`)
+	drained := make(chan struct{})
+	stream.dispatch(func() { close(drained) })
+	<-drained
+	if got := len(fake.sentMessages()); got != 2 {
+		t.Errorf("%v messages after repeated and malformed feeds, want 2", got)
+	}
+}